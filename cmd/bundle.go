@@ -0,0 +1,88 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cmd
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/dop251/goja"
+	"github.com/loadimpact/k6/js"
+	"github.com/loadimpact/k6/loader"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+var bundleOutput string
+
+// bundleCmd implements `k6 bundle`: it runs a script's init phase the same
+// way `k6 run` would, except every requireFile() and Open() call is also
+// captured into a self-contained archive (see newInitContextFor in run.go
+// for the other end of that round trip).
+var bundleCmd = &cobra.Command{
+	Use:   "bundle [file]",
+	Short: "Bundle a test script and its dependencies into a single archive",
+	Long: `Bundle a test script and its dependencies into a single archive.
+
+The script's init phase is run once, with every requireFile() and Open()
+call it makes recorded into the archive alongside the transformed source or
+raw bytes it produced (programs are recompiled from that source when the
+archive is loaded). "k6 run" on the resulting archive replays those
+calls from the recording instead of resolving them again.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runBundle(args[0], bundleOutput)
+	},
+}
+
+func init() {
+	bundleCmd.Flags().StringVarP(&bundleOutput, "out", "o", "bundle.tar", "bundle output path")
+}
+
+func runBundle(scriptPath, outPath string) error {
+	abs, err := filepath.Abs(scriptPath)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't resolve %q", scriptPath)
+	}
+	entryURL := &url.URL{Scheme: "file", Path: abs}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %q", outPath)
+	}
+	defer func() { _ = out.Close() }()
+
+	archive := loader.NewArchiveWriter(out, entryURL.String())
+
+	rt := goja.New()
+	ctxPtr := new(context.Context)
+	*ctxPtr = context.Background()
+
+	initCtx := js.NewRecordingInitContext(rt, ctxPtr, afero.NewOsFs(), loader.Dir(entryURL), archive)
+	if err := requireEntry(initCtx, entryURL.String()); err != nil {
+		return errors.Wrap(err, "running the init phase for bundling failed")
+	}
+
+	return archive.Close()
+}
@@ -0,0 +1,113 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/dop251/goja"
+	"github.com/loadimpact/k6/js"
+	"github.com/loadimpact/k6/loader"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+// runCmd implements `k6 run`: it runs a script's init phase, same as
+// bundleCmd, except it doesn't record anything. file may be a plain test
+// script or a bundle produced by `k6 bundle` - runRun tells the two apart by
+// trying to read file as a bundle archive first.
+var runCmd = &cobra.Command{
+	Use:   "run [file]",
+	Short: "Run a test script or a bundle produced by `k6 bundle`",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runRun(args[0])
+	},
+}
+
+func runRun(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %q", path)
+	}
+
+	rt := goja.New()
+	ctxPtr := new(context.Context)
+	*ctxPtr = context.Background()
+
+	initCtx, entry, err := newInitContextFor(rt, ctxPtr, path, data)
+	if err != nil {
+		return err
+	}
+
+	if err := requireEntry(initCtx, entry); err != nil {
+		return errors.Wrap(err, "running the init phase failed")
+	}
+	return nil
+}
+
+// newInitContextFor builds the InitContext path isn't a bundle or is one.
+// Only the init phase this package already knows how to run is wired up
+// here; there's no VU loop anywhere in this tree for either path to hand
+// off into once the init phase completes.
+func newInitContextFor(
+	rt *goja.Runtime, ctxPtr *context.Context, path string, data []byte,
+) (initCtx *js.InitContext, entry string, err error) {
+	if manifest, archiveFs, archErr := loader.OpenArchive(bytes.NewReader(data)); archErr == nil {
+		initCtx, err = js.NewInitContextFromArchive(rt, ctxPtr, manifest, archiveFs)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "couldn't load bundle %q", path)
+		}
+		return initCtx, manifest.Entry, nil
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "couldn't resolve %q", path)
+	}
+	entryURL := &url.URL{Scheme: "file", Path: abs}
+	initCtx = js.NewInitContext(rt, ctxPtr, afero.NewOsFs(), loader.Dir(entryURL))
+	return initCtx, entryURL.String(), nil
+}
+
+// requireEntry runs entry's init phase to completion, converting the panic
+// InitContext.Require throws on failure (it's meant to unwind through
+// goja's own call mechanism, not a bare Go call like this one) into a
+// regular error.
+func requireEntry(initCtx *js.InitContext, entry string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	initCtx.Require(entry)
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+// TestRunArchiveRoundTrip bundles a script and then runs the resulting
+// archive back through newInitContextFor/requireEntry, without touching the
+// original script file again - the same round trip `k6 bundle` followed by
+// `k6 run bundle.tar` exercises.
+func TestRunArchiveRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "script.js")
+	if err := os.WriteFile(scriptPath, []byte("1 + 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	bundlePath := filepath.Join(dir, "bundle.tar")
+	if err := runBundle(scriptPath, bundlePath); err != nil {
+		t.Fatalf("runBundle: %v", err)
+	}
+
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := goja.New()
+	ctxPtr := new(context.Context)
+	*ctxPtr = context.Background()
+
+	initCtx, entry, err := newInitContextFor(rt, ctxPtr, bundlePath, data)
+	if err != nil {
+		t.Fatalf("newInitContextFor: %v", err)
+	}
+	if entry == "" {
+		t.Fatalf("expected a non-empty entry specifier")
+	}
+	if err := requireEntry(initCtx, entry); err != nil {
+		t.Fatalf("requireEntry: %v", err)
+	}
+
+	// A plain (non-archive) script should still be recognized as such,
+	// rather than being mistaken for a malformed archive.
+	initCtx2, entry2, err := newInitContextFor(rt, ctxPtr, scriptPath, []byte("1 + 1;"))
+	if err != nil {
+		t.Fatalf("newInitContextFor (plain script): %v", err)
+	}
+	if want := "file://" + scriptPath; entry2 != want {
+		t.Errorf("entry = %q, want %q", entry2, want)
+	}
+	if err := requireEntry(initCtx2, entry2); err != nil {
+		t.Fatalf("requireEntry (plain script): %v", err)
+	}
+}
+
+// TestRunBundleRejectsESM checks that `k6 bundle` refuses a script using
+// import/export rather than silently producing an archive that would throw
+// ReferenceErrors on every import once `k6 run` replayed it - the archive
+// format doesn't persist the module graph moduleArgs needs.
+func TestRunBundleRejectsESM(t *testing.T) {
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "script.js")
+	if err := os.WriteFile(scriptPath, []byte("export const x = 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runBundle(scriptPath, filepath.Join(dir, "bundle.tar"))
+	if err == nil {
+		t.Fatalf("expected runBundle to reject an ES-module script, got no error")
+	}
+}
+
+// TestRunBundleReplaysBareSpecifier bundles a script that require()s a bare
+// (node_modules) specifier and then replays the resulting archive, to check
+// that the replay resolves the require through the recorded alias rather
+// than trying (and failing) to walk node_modules against the archive's flat
+// in-memory filesystem.
+func TestRunBundleReplaysBareSpecifier(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "node_modules", "dep"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(
+		filepath.Join(dir, "node_modules", "dep", "index.js"), []byte("module.exports = 42;"), 0o644,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	scriptPath := filepath.Join(dir, "script.js")
+	if err := os.WriteFile(scriptPath, []byte("require('dep');"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	bundlePath := filepath.Join(dir, "bundle.tar")
+	if err := runBundle(scriptPath, bundlePath); err != nil {
+		t.Fatalf("runBundle: %v", err)
+	}
+
+	// Move the node_modules tree out of the way so a successful replay can
+	// only be explained by the archive's alias, not by falling through to
+	// the real filesystem.
+	if err := os.RemoveAll(filepath.Join(dir, "node_modules")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := goja.New()
+	ctxPtr := new(context.Context)
+	*ctxPtr = context.Background()
+
+	initCtx, entry, err := newInitContextFor(rt, ctxPtr, bundlePath, data)
+	if err != nil {
+		t.Fatalf("newInitContextFor: %v", err)
+	}
+	if err := requireEntry(initCtx, entry); err != nil {
+		t.Fatalf("requireEntry: %v", err)
+	}
+}
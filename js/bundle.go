@@ -0,0 +1,131 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package js
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"net/url"
+
+	"github.com/dop251/goja"
+	"github.com/loadimpact/k6/js/compiler"
+	"github.com/loadimpact/k6/loader"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// NewRecordingInitContext is like NewInitContext, except every requireFile
+// and Open call made through the returned InitContext is also captured into
+// w - the transformed source (and its source map) for the former, the raw
+// bytes for the latter - so the whole init phase can be replayed later
+// without touching the filesystem or network again. The compiled program
+// itself isn't recorded; it's recompiled from the source on replay. Call
+// w.Close once the init phase has run to completion to flush the archive's
+// manifest.
+func NewRecordingInitContext(
+	rt *goja.Runtime, ctxPtr *context.Context, fs afero.Fs, pwd *url.URL, w *loader.ArchiveWriter,
+) *InitContext {
+	i := NewInitContext(rt, ctxPtr, fs, pwd)
+	i.recorder = w
+	return i
+}
+
+// NewInitContextFromArchive rehydrates an InitContext from a bundle written
+// by a recording InitContext: its programs and files caches are
+// pre-populated from the archive's blobs, so requireFile and Open are
+// satisfied without touching the filesystem or network, and its fs is the
+// archive's own in-memory filesystem for anything that wasn't recorded.
+func NewInitContextFromArchive(
+	rt *goja.Runtime, ctxPtr *context.Context, manifest *loader.ArchiveManifest, archiveFs afero.Fs,
+) (*InitContext, error) {
+	entryURL, err := url.Parse(manifest.Entry)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't parse bundle entrypoint")
+	}
+
+	i := NewInitContext(rt, ctxPtr, archiveFs, loader.Dir(entryURL))
+
+	for specifier, entry := range manifest.Files {
+		blob, err := afero.ReadFile(archiveFs, entry.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read bundled entry for %q", specifier)
+		}
+
+		switch entry.Kind {
+		case loader.ArchiveEntryModule:
+			var pws gobProgramWithSource
+			if err := gob.NewDecoder(bytes.NewReader(blob)).Decode(&pws); err != nil {
+				return nil, errors.Wrapf(err, "couldn't decode bundled program for %q", specifier)
+			}
+			// goja.Program has no exported fields, so what's actually
+			// archived is the source it was compiled from; recompile it
+			// here rather than trying to rehydrate bytecode that was never
+			// serialized in the first place.
+			pgm, err := goja.Compile(specifier, pws.Source, true)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't recompile bundled program for %q", specifier)
+			}
+			i.programs[specifier] = programWithSource{pgm: pgm, src: pws.Source, srcMap: pws.SrcMap}
+		case loader.ArchiveEntryOpen:
+			i.files[specifier] = blob
+		}
+	}
+
+	for specifier, target := range manifest.Aliases {
+		i.specifierAliases[specifier] = target
+	}
+
+	return i, nil
+}
+
+// gobProgramWithSource is the gob-friendly shape programWithSource is
+// recorded/rehydrated as. Source and SrcMap make the trip; programWithSource's
+// *goja.Program doesn't - it has no exported fields (and no GobEncode of its
+// own), so it can't be archived directly and is recompiled from Source
+// instead (same trade-off the disk program cache makes).
+type gobProgramWithSource struct {
+	Source string
+	SrcMap *compiler.SourceMap
+}
+
+// recordModule captures filename's transformed source into the context's
+// recorder, if one is attached, to be recompiled when the bundle is read
+// back (see NewInitContextFromArchive).
+func (i *InitContext) recordModule(filename string, pws programWithSource) {
+	if i.recorder == nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gobProgramWithSource{Source: pws.src, SrcMap: pws.srcMap}); err != nil {
+		return
+	}
+	_ = i.recorder.Put(filename, loader.ArchiveEntryModule, buf.Bytes())
+}
+
+// recordOpen captures the raw bytes an open() call returned into the
+// context's recorder, if one is attached.
+func (i *InitContext) recordOpen(filename string, data []byte) {
+	if i.recorder == nil {
+		return
+	}
+	_ = i.recorder.Put(filename, loader.ArchiveEntryOpen, data)
+}
@@ -0,0 +1,101 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package compiler turns ES6+ user scripts into sources goja can compile,
+// and tells the JS runtime whether a given source is a CommonJS file or a
+// native ES module.
+package compiler
+
+import (
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
+	"github.com/pkg/errors"
+)
+
+// Transform takes a JS source and transforms it into one goja.Compile can
+// consume, returning the transformed source. The returned SourceMap is
+// always nil: source goja parses as-is needs none, and the Babel step (see
+// babelTransform) returns src unchanged without producing one.
+func Transform(src, filename string) (string, *SourceMap, error) {
+	prog, err := Parse(src, filename)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "couldn't parse %s", filename)
+	}
+	if prog != nil {
+		// Already valid ES5/goja-native syntax; nothing to transform and thus
+		// no position drift to track.
+		return src, nil, nil
+	}
+
+	// Anything goja's own parser can't handle on its own (newer syntax, JSX,
+	// etc.) goes through Babel - or would, once babelTransform is actually
+	// wired up to a Babel bridge (see its doc comment); for now it returns
+	// src unchanged with no source map, so there's nothing here yet to
+	// translate stack traces back through.
+	out, _, err := babelTransform(src, filename)
+	if err != nil {
+		return "", nil, err
+	}
+	return out, nil, nil
+}
+
+// Parse parses src with goja's own parser, returning the AST on success and
+// (nil, nil) - not an error - if src isn't valid as-is, so callers can fall
+// back to a transform step instead of treating it as fatal.
+func Parse(src, filename string) (*ast.Program, error) {
+	prog, err := parser.ParseFile(nil, filename, src, 0)
+	if err != nil {
+		return nil, nil //nolint:nilerr
+	}
+	return prog, nil
+}
+
+// IsModule reports whether src uses native ES module syntax (a top-level
+// import or export declaration), as opposed to being a plain CommonJS
+// script.
+//
+// This can't be answered from Parse's AST: goja's parser (like its lexer)
+// has no grammar for import/export at all, so Parse returns (nil, nil) -
+// "not valid as-is", the same as for any other syntax it can't handle - for
+// any source that uses them. IsModule instead scans src's text directly for
+// a top-level import/export, the same way DesugarModule finds them to
+// rewrite.
+func IsModule(src string) bool {
+	lx := newLexer(src)
+	depth := 0
+	prevText := ""
+	for {
+		tok := lx.next()
+		if tok.kind == tEOF {
+			return false
+		}
+		if depth == 0 && tok.kind == tWord && prevText != "." &&
+			(tok.text == "import" || tok.text == "export") {
+			return true
+		}
+		switch tok.text {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		}
+		prevText = tok.text
+	}
+}
@@ -0,0 +1,317 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package compiler
+
+// lexer is a small, deliberately incomplete JS tokenizer: just enough to
+// find import/export declarations (and where they end) in arbitrary source
+// without caring what the rest of it means. It isn't a replacement for a
+// real parser - it doesn't build a tree, doesn't validate grammar, and a
+// handful of constructs (`export` used as an object property key, say) can
+// still fool it - but DesugarModule only ever needs byte offsets and
+// bracket-balance, not semantics.
+type lexer struct {
+	src      string
+	pos      int
+	buffered *token
+	lastKind tokenKind
+	lastText string
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src}
+}
+
+type tokenKind int
+
+const (
+	tEOF tokenKind = iota
+	tWord
+	tString
+	tNumber
+	tPunct
+)
+
+// token is one lexical token. For tString, text is the literal including
+// its quotes (or backticks, or for a regex, its slashes and flags) -
+// decodeStringLiteral strips those off for the cases that need the value.
+type token struct {
+	kind     tokenKind
+	text     string
+	start    int
+	end      int
+	nlBefore bool // a line terminator appeared before this token (for ASI)
+}
+
+// unread pushes t back, so the next call to next returns it again. Only one
+// token of lookahead is ever needed by this package's parsing.
+func (l *lexer) unread(t token) {
+	l.buffered = &t
+}
+
+// next returns the next token, consuming it.
+func (l *lexer) next() token {
+	if l.buffered != nil {
+		t := *l.buffered
+		l.buffered = nil
+		return t
+	}
+	t := l.scan()
+	l.lastKind, l.lastText = t.kind, t.text
+	return t
+}
+
+func (l *lexer) scan() token {
+	nl := l.skipTrivia()
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tEOF, start: start, end: start, nlBefore: nl}
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case c == '\'' || c == '"':
+		end := scanStringLiteral(l.src, l.pos)
+		l.pos = end
+		return token{kind: tString, text: l.src[start:end], start: start, end: end, nlBefore: nl}
+	case c == '`':
+		end := scanTemplateLiteral(l.src, l.pos)
+		l.pos = end
+		return token{kind: tString, text: l.src[start:end], start: start, end: end, nlBefore: nl}
+	case isDigit(c):
+		end := scanNumberLiteral(l.src, l.pos)
+		l.pos = end
+		return token{kind: tNumber, text: l.src[start:end], start: start, end: end, nlBefore: nl}
+	case isIdentStartByte(c):
+		end := l.pos
+		for end < len(l.src) && isIdentPartByte(l.src[end]) {
+			end++
+		}
+		l.pos = end
+		return token{kind: tWord, text: l.src[start:end], start: start, end: end, nlBefore: nl}
+	case c == '/' && l.regexAllowed():
+		end := scanRegexLiteral(l.src, l.pos)
+		l.pos = end
+		return token{kind: tString, text: l.src[start:end], start: start, end: end, nlBefore: nl}
+	default:
+		end := l.pos + 1
+		if end < len(l.src) && twoCharOps[l.src[l.pos:end+1]] {
+			end++
+		}
+		l.pos = end
+		return token{kind: tPunct, text: l.src[start:end], start: start, end: end, nlBefore: nl}
+	}
+}
+
+// twoCharOps lists the multi-character operators worth recognizing as a
+// single token; "=>" is the one that actually matters (see
+// scanStatementEnd's continuesExpression), the rest are along for the ride
+// since they're no more work to include.
+var twoCharOps = map[string]bool{
+	"=>": true, "==": true, "!=": true, "<=": true, ">=": true,
+	"&&": true, "||": true, "??": true, "?.": true,
+	"++": true, "--": true, "**": true,
+	"+=": true, "-=": true, "*=": true, "/=": true,
+}
+
+// regexAllowedKeywords are the keywords after which a '/' starts a new
+// expression (and so can't be the division operator) - a regex literal is
+// one of the expressions it can start.
+var regexAllowedKeywords = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true, "of": true,
+	"new": true, "delete": true, "void": true, "case": true, "do": true,
+	"else": true, "throw": true, "yield": true, "await": true,
+}
+
+// regexAllowed decides whether a '/' at the current position starts a
+// regex literal or is the division/divide-assign operator, based on the
+// last significant token scanned. This is the same ambiguity every JS
+// tokenizer has to resolve; get it wrong and a comment or statement
+// boundary inside a regex (or vice versa) throws everything downstream off.
+func (l *lexer) regexAllowed() bool {
+	switch l.lastKind {
+	case tEOF:
+		return true
+	case tNumber, tString:
+		return false
+	case tWord:
+		return regexAllowedKeywords[l.lastText]
+	case tPunct:
+		return l.lastText != ")" && l.lastText != "]"
+	}
+	return true
+}
+
+// skipTrivia advances past whitespace and comments, reporting whether a
+// line terminator was seen anywhere in what it skipped.
+func (l *lexer) skipTrivia() (sawNL bool) {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			sawNL = true
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f':
+			l.pos++
+		case c == '/' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '/':
+			l.pos += 2
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '/' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '*':
+			l.pos += 2
+			for l.pos < len(l.src) && !(l.src[l.pos] == '*' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '/') {
+				if l.src[l.pos] == '\n' {
+					sawNL = true
+				}
+				l.pos++
+			}
+			l.pos += 2
+			if l.pos > len(l.src) {
+				l.pos = len(l.src)
+			}
+		default:
+			return sawNL
+		}
+	}
+	return sawNL
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// isIdentStartByte treats any non-ASCII byte as a possible identifier
+// start/continuation too, so multi-byte UTF-8 identifiers are consumed as
+// one token rather than splitting on every byte - not a correctness
+// requirement for this package's purposes, just tidiness.
+func isIdentStartByte(c byte) bool {
+	return c == '_' || c == '$' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		c >= 0x80
+}
+
+func isIdentPartByte(c byte) bool {
+	return isIdentStartByte(c) || isDigit(c)
+}
+
+// scanStringLiteral returns the offset right after the string starting at
+// i (src[i] is the opening quote), handling backslash escapes.
+func scanStringLiteral(src string, i int) int {
+	quote := src[i]
+	i++
+	for i < len(src) {
+		switch src[i] {
+		case '\\':
+			i += 2
+			continue
+		case quote:
+			return i + 1
+		case '\n':
+			return i // unterminated string; bail rather than run off
+		}
+		i++
+	}
+	return i
+}
+
+// scanTemplateLiteral returns the offset right after the template literal
+// starting at i (src[i] is the opening backtick), recursing through any
+// `${...}` substitutions (which may themselves contain strings, templates
+// and braces that need to be balanced, not just textually searched for the
+// next backtick).
+func scanTemplateLiteral(src string, i int) int {
+	i++
+	for i < len(src) {
+		switch c := src[i]; {
+		case c == '\\':
+			i += 2
+		case c == '`':
+			return i + 1
+		case c == '$' && i+1 < len(src) && src[i+1] == '{':
+			i += 2
+			depth := 1
+			for i < len(src) && depth > 0 {
+				switch src[i] {
+				case '{':
+					depth++
+					i++
+				case '}':
+					depth--
+					i++
+				case '\'', '"':
+					i = scanStringLiteral(src, i)
+				case '`':
+					i = scanTemplateLiteral(src, i)
+				default:
+					i++
+				}
+			}
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// scanRegexLiteral returns the offset right after the regex literal
+// (including its flags) starting at i (src[i] is the opening '/').
+func scanRegexLiteral(src string, i int) int {
+	i++
+	inClass := false
+	for i < len(src) {
+		switch c := src[i]; {
+		case c == '\\':
+			i += 2
+		case c == '[':
+			inClass = true
+			i++
+		case c == ']':
+			inClass = false
+			i++
+		case c == '/' && !inClass:
+			i++
+			for i < len(src) && isIdentPartByte(src[i]) {
+				i++
+			}
+			return i
+		case c == '\n':
+			return i // unterminated regex; bail rather than run off
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// scanNumberLiteral returns the offset right after the numeric literal
+// starting at i; permissive rather than a strict validator, since all
+// this package needs is to not mistake a trailing '/' for a regex.
+func scanNumberLiteral(src string, i int) int {
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case isDigit(c), c == '.', c == '_':
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			// hex/octal/binary prefixes and exponent markers
+		default:
+			return i
+		}
+		i++
+	}
+	return i
+}
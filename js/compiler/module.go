@@ -0,0 +1,598 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package compiler
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ImportedDefault and ImportedNamespace are the special "imported" names an
+// ImportBinding.Imported can carry for `import foo from '...'` and
+// `import * as foo from '...'`, as opposed to naming an actual export.
+const (
+	ImportedDefault   = "default"
+	ImportedNamespace = "*"
+)
+
+// ImportBinding is one name a module imports from another: the name it's
+// bound to locally, and which export of the dependency it's bound to
+// (ImportedDefault, ImportedNamespace, or a named export).
+type ImportBinding struct {
+	Local    string
+	Imported string
+}
+
+// ModuleImport is everything DesugarModule needs the caller to link and,
+// later, instantiate bindings for: the dependency's specifier, and the
+// bindings (if any - a side-effect-only `import '...'` has none) it introduces.
+type ModuleImport struct {
+	Source   string
+	Bindings []ImportBinding
+}
+
+// DesugarModule rewrites src's import/export syntax out, producing plain
+// source goja.Compile can consume: `import` statements are removed entirely
+// (the bindings they'd introduce are returned instead, for the caller to
+// instantiate - see js.InitContext.evaluateModule) and `export` statements
+// are rewritten into assignments onto `exports`, the same protocol plain
+// CommonJS files use.
+//
+// Unlike a real transform, this doesn't work off an AST: goja's parser has
+// no grammar for import/export at all (see IsModule), so there's no tree to
+// walk. Import/export declarations are found and parsed directly out of
+// src's text by the small hand-rolled lexer in lexer.go; everything else is
+// copied through untouched without being understood at all, which is also
+// why this doesn't re-print anything: most line numbers survive verbatim,
+// and the returned SourceMap only has to track the handful that don't (an
+// import's own line disappearing, or an `export <decl>` gaining a trailing
+// `exports.x = x;` line).
+func DesugarModule(src, filename string) (string, []ModuleImport, *SourceMap, error) {
+	d := &desugarer{filename: filename, origLine: 1}
+	var imports []ModuleImport
+	last := 0
+
+	lx := newLexer(src)
+	depth := 0
+	prevText := ""
+	for {
+		tok := lx.next()
+		if tok.kind == tEOF {
+			break
+		}
+
+		isDecl := depth == 0 && tok.kind == tWord && prevText != "." &&
+			(tok.text == "import" || tok.text == "export")
+
+		switch tok.text {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		}
+		if !isDecl {
+			prevText = tok.text
+			continue
+		}
+
+		start := tok.start
+		d.copy(src[last:start])
+
+		var end int
+		var err error
+		if tok.text == "import" {
+			var imp *ModuleImport
+			end, imp, err = parseImport(src, lx)
+			if err == nil {
+				d.skip(src[start:end])
+				imports = append(imports, *imp)
+			}
+		} else {
+			end, err = parseExport(filename, src, lx, d)
+		}
+		if err != nil {
+			return "", nil, nil, err
+		}
+		last = end
+		prevText = ""
+	}
+	d.copy(src[last:])
+
+	return d.out.String(), imports, d.sourceMap(), nil
+}
+
+// WrapModuleBody wraps body - DesugarModule's output - in a function
+// expression taking params as its parameter list, so the caller can run the
+// returned source to get that function back and then call it with each
+// import's resolved value passed positionally, in the same order as params.
+//
+// This is what makes an ES module's imports resolve in a scope private to
+// that module: a real function parameter, rather than a property on the
+// runtime's shared global object that a second module importing something
+// under the same local name would silently overwrite (see
+// js.InitContext.evaluateModule). The trade-off is that, unlike a real ES
+// "live binding", a param is a snapshot taken once, at call time - a module
+// that mutates one of its exports after an importer's top-level body has
+// already run won't be seen by that importer. k6 scripts import functions
+// and constants, not mutable counters, so this hasn't been worth the extra
+// complexity of rewriting every use of an imported name into a property
+// access instead.
+//
+// bodyMap is the SourceMap DesugarModule returned alongside body (nil if
+// body is a single line); the returned SourceMap accounts for the
+// wrapper's opening line shifting every line of body down by one.
+func WrapModuleBody(filename, body string, bodyMap *SourceMap, params []string) (string, *SourceMap) {
+	wrapped := "(function(" + strings.Join(params, ", ") + ") {\n" + body + "\n});"
+
+	var origLines []int
+	if bodyMap != nil {
+		origLines = make([]int, len(bodyMap.mappings))
+		for i, row := range bodyMap.mappings {
+			origLines[i] = row[0].srcLine + 1
+		}
+	} else {
+		// No map was built (body is a single line, or was never desugared), so
+		// each of body's lines maps to the original line of the same number.
+		origLines = make([]int, strings.Count(body, "\n")+1)
+		for i := range origLines {
+			origLines[i] = i + 1
+		}
+	}
+	lines := append([]int{1}, origLines...)
+
+	mappings := make([][]sourceMapping, len(lines))
+	for i, origLine := range lines {
+		mappings[i] = []sourceMapping{{genCol: 0, sourceIdx: 0, srcLine: origLine - 1, srcCol: 0}}
+	}
+	return wrapped, &SourceMap{File: filename, Sources: []string{filename}, mappings: mappings}
+}
+
+// desugarer writes DesugarModule's output while tracking, line by line,
+// which original line each generated line came from.
+type desugarer struct {
+	out      strings.Builder
+	filename string
+	origLine int // 1-based line in src the writer's "read cursor" is at
+	lineMap  []int
+}
+
+// copy appends text taken verbatim from src, advancing the original line
+// counter as it goes; each generated line it produces maps to the original
+// line of the same name, so it's recorded too.
+func (d *desugarer) copy(text string) {
+	d.out.WriteString(text)
+	for _, r := range text {
+		if r == '\n' {
+			d.origLine++
+			d.lineMap = append(d.lineMap, d.origLine)
+		}
+	}
+}
+
+// skip advances the original line counter for text dropped from the output
+// entirely (an `import` statement's own span), without writing anything or
+// advancing the generated line counter.
+func (d *desugarer) skip(text string) {
+	for _, r := range text {
+		if r == '\n' {
+			d.origLine++
+		}
+	}
+}
+
+// insert appends text that has no counterpart in src (the `exports.x = x;`
+// lines DesugarModule adds). Any new generated lines it creates are
+// attributed to the original line the writer was already at, since that's
+// the closest thing src has to a "this came from here".
+func (d *desugarer) insert(text string) {
+	d.out.WriteString(text)
+	for _, r := range text {
+		if r == '\n' {
+			d.lineMap = append(d.lineMap, d.origLine)
+		}
+	}
+}
+
+// sourceMap returns the SourceMap this desugarer has been building, or nil
+// if the output has no line break at all (in which case its single line
+// maps to src's first line and no remapping is needed).
+func (d *desugarer) sourceMap() *SourceMap {
+	if len(d.lineMap) == 0 {
+		return nil
+	}
+	lines := append([]int{1}, d.lineMap...)
+	mappings := make([][]sourceMapping, len(lines))
+	for i, origLine := range lines {
+		mappings[i] = []sourceMapping{{genCol: 0, sourceIdx: 0, srcLine: origLine - 1, srcCol: 0}}
+	}
+	return &SourceMap{File: d.filename, Sources: []string{d.filename}, mappings: mappings}
+}
+
+// parseImport parses one `import ...;` declaration out of src, with lx
+// positioned right after the already-consumed `import` keyword. It returns
+// the byte offset immediately after the declaration (including a trailing
+// semicolon, if any) and the ModuleImport it describes.
+func parseImport(src string, lx *lexer) (int, *ModuleImport, error) {
+	var bindings []ImportBinding
+
+	tok := lx.next()
+	if tok.kind == tString {
+		// Side-effect-only import: `import 'foo';` - no bindings.
+		end := consumeOptionalSemicolon(lx, tok.end)
+		return end, &ModuleImport{Source: decodeStringLiteral(tok.text)}, nil
+	}
+
+	if tok.kind == tWord {
+		// DefaultBinding, optionally followed by a NamespaceImport or
+		// NamedImports.
+		bindings = append(bindings, ImportBinding{Local: tok.text, Imported: ImportedDefault})
+		tok = lx.next()
+		if tok.text == "," {
+			tok = lx.next()
+		}
+	}
+
+	switch tok.text {
+	case "*":
+		asTok := lx.next()
+		if asTok.text != "as" {
+			return 0, nil, errors.Errorf("expected 'as' after '*' in import declaration, got %q", asTok.text)
+		}
+		nameTok := lx.next()
+		bindings = append(bindings, ImportBinding{Local: nameTok.text, Imported: ImportedNamespace})
+		tok = lx.next()
+	case "{":
+		for {
+			t := lx.next()
+			if t.text == "}" {
+				tok = lx.next()
+				break
+			}
+			if t.text == "," {
+				continue
+			}
+			imported, local := t.text, t.text
+			nxt := lx.next()
+			if nxt.text == "as" {
+				local = lx.next().text
+			} else {
+				lx.unread(nxt)
+			}
+			bindings = append(bindings, ImportBinding{Local: local, Imported: imported})
+		}
+	}
+
+	if tok.text != "from" {
+		return 0, nil, errors.Errorf("expected 'from' in import declaration, got %q", tok.text)
+	}
+	srcTok := lx.next()
+	if srcTok.kind != tString {
+		return 0, nil, errors.New("expected a string literal after 'from'")
+	}
+	end := consumeOptionalSemicolon(lx, srcTok.end)
+	return end, &ModuleImport{Source: decodeStringLiteral(srcTok.text), Bindings: bindings}, nil
+}
+
+// parseExport parses one `export ...` declaration out of src, with lx
+// positioned right after the already-consumed `export` keyword, writing its
+// desugared replacement straight onto d. It returns the byte offset
+// immediately after the declaration.
+func parseExport(filename, src string, lx *lexer, d *desugarer) (int, error) {
+	tok := lx.next()
+	switch tok.text {
+	case "default":
+		exprStart := tok.end
+		end, err := scanStatementEnd(lx)
+		if err != nil {
+			return 0, errors.Wrapf(err, "%s: export default", filename)
+		}
+		// end includes the statement's own ';', if it has one; that has to
+		// stay outside the parentheses, where the ");" below stands in for it.
+		exprEnd := end
+		if exprEnd > exprStart && src[exprEnd-1] == ';' {
+			exprEnd--
+		}
+		d.insert("exports.default = (")
+		d.copy(src[exprStart:exprEnd])
+		d.insert(");")
+		return end, nil
+
+	case "const", "let", "var":
+		end, err := scanStatementEnd(lx)
+		if err != nil {
+			return 0, errors.Wrapf(err, "%s: export %s", filename, tok.text)
+		}
+		d.copy(src[tok.start:end])
+		for _, name := range topLevelVarNames(src, tok.start, end) {
+			d.insert("\nexports." + name + " = " + name + ";")
+		}
+		return end, nil
+
+	case "function", "class":
+		nameTok := lx.next()
+		if tok.text == "function" && nameTok.text == "*" { // generator function
+			nameTok = lx.next()
+		}
+		if nameTok.kind != tWord {
+			return 0, errors.Errorf("%s: expected a name after 'export %s'", filename, tok.text)
+		}
+		end, err := scanToBody(lx)
+		if err != nil {
+			return 0, errors.Wrapf(err, "%s: export %s %s", filename, tok.text, nameTok.text)
+		}
+		d.copy(src[tok.start:end])
+		d.insert("\nexports." + nameTok.text + " = " + nameTok.text + ";")
+		return end, nil
+
+	case "{":
+		lx.unread(tok)
+		return parseExportNamed(filename, lx, d)
+
+	case "*":
+		return 0, errors.Errorf(
+			"%s: re-export syntax (`export * from '...'`) isn't supported yet", filename)
+
+	default:
+		return 0, errors.Errorf("%s: unsupported export syntax near %q", filename, tok.text)
+	}
+}
+
+// parseExportNamed parses `export { a, b as c };`, with lx positioned right
+// before the opening `{` - or rejects it as an unsupported re-export if it
+// turns out to be `export { a, b as c } from '...';` instead.
+func parseExportNamed(filename string, lx *lexer, d *desugarer) (int, error) {
+	lx.next() // the '{'
+
+	type spec struct{ local, exported string }
+	var specs []spec
+	closeEnd := 0
+	for {
+		t := lx.next()
+		if t.text == "}" {
+			closeEnd = t.end
+			break
+		}
+		if t.text == "," {
+			continue
+		}
+		if t.kind != tWord {
+			return 0, errors.Errorf("%s: unexpected token %q in export list", filename, t.text)
+		}
+		local, exported := t.text, t.text
+		nxt := lx.next()
+		if nxt.text == "as" {
+			exported = lx.next().text
+		} else {
+			lx.unread(nxt)
+		}
+		specs = append(specs, spec{local: local, exported: exported})
+	}
+
+	fromTok := lx.next()
+	if fromTok.text == "from" {
+		return 0, errors.Errorf(
+			"%s: re-export syntax (`export ... from '...'`) isn't supported yet", filename)
+	}
+	lx.unread(fromTok)
+
+	end := consumeOptionalSemicolon(lx, closeEnd)
+	for _, s := range specs {
+		d.insert("exports." + s.exported + " = " + s.local + ";\n")
+	}
+	return end, nil
+}
+
+// topLevelVarNames extracts the simple (non-destructured) binding names a
+// `const`/`let`/`var` declaration spanning src[start:end] introduces;
+// destructuring targets (`const {a, b} = ...`) are silently skipped, the
+// same as this desugaring only ever handling plain identifier bindings.
+func topLevelVarNames(src string, start, end int) []string {
+	lx := newLexer(src[:end])
+	lx.pos = start
+	lx.next() // the const/let/var keyword itself
+
+	var names []string
+	expectName := true
+	depth := 0
+	for {
+		tok := lx.next()
+		if tok.kind == tEOF {
+			return names
+		}
+		switch tok.text {
+		case "(", "[", "{":
+			depth++
+			continue
+		case ")", "]", "}":
+			depth--
+			continue
+		}
+		if depth != 0 {
+			continue
+		}
+		if expectName && tok.kind == tWord {
+			names = append(names, tok.text)
+		}
+		expectName = tok.text == ","
+	}
+}
+
+// scanStatementEnd scans lx forward, tracking bracket depth, until that
+// depth returns to zero and either a ';' is found (consumed) or the next
+// token starts on a new line and isn't one of the few tokens that can
+// legally continue an expression onto the next line (ASI) - or until EOF.
+// It returns the offset immediately after the statement, and never
+// consumes tokens belonging to whatever follows.
+//
+// This is what finds the end of an `export default <expr>` and an
+// `export const/let/var ...`; a declaration's own grammar never embeds a
+// bare top-level statement sequence outside of a nested function/class
+// body (which is protected by its own enclosing braces raising depth
+// first), so the only real ambiguity this has to get right is distinguishing
+// "the declaration continues on the next line" from "a new statement starts
+// here" - see continuesExpression.
+func scanStatementEnd(lx *lexer) (int, error) {
+	depth := 0
+	for {
+		tok := lx.next()
+		if tok.kind == tEOF {
+			return tok.start, nil
+		}
+		switch tok.text {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+			if depth < 0 {
+				return 0, errors.New("unbalanced brackets")
+			}
+		}
+		if depth > 0 {
+			continue
+		}
+		if tok.text == ";" {
+			return tok.end, nil
+		}
+		nxt := lx.next()
+		lx.unread(nxt)
+		if nxt.kind == tEOF {
+			return tok.end, nil
+		}
+		if nxt.text == ";" {
+			lx.next()
+			return nxt.end, nil
+		}
+		if nxt.nlBefore && !continuesExpression(nxt) {
+			return tok.end, nil
+		}
+	}
+}
+
+// continuesExpression reports whether t is a token that can only appear as
+// a continuation of the expression/declaration before it, so a line break
+// immediately before it must not be read as ASI. "{" is included for arrow
+// function and block-less control-flow bodies (`() => {...}`); the cost is
+// that a semicolon-less top-level block statement right after a
+// declaration (a vanishingly rare style in practice) would be folded into
+// it instead of starting fresh.
+func continuesExpression(t token) bool {
+	if t.kind == tWord {
+		return t.text == "instanceof" || t.text == "in"
+	}
+	switch t.text {
+	case ".", "(", "[", "{", "`",
+		"+", "-", "*", "/", "%",
+		"<", ">", "=", "!", "&", "|", "^", "~", "?", ":", ",", "=>":
+		return true
+	}
+	return false
+}
+
+// scanToBody scans lx forward, tracking only "(" / "[" depth, until it
+// finds the "{" that opens a function or class declaration's body (the
+// first one that isn't nested inside a parameter list or, for a class, an
+// `extends` clause's arguments), then balances that brace against its
+// matching "}". It returns the offset immediately after that closing brace
+// - function and class declarations don't need a trailing semicolon (or
+// ASI) to end, so scanStatementEnd's heuristics don't apply to them.
+func scanToBody(lx *lexer) (int, error) {
+	parenDepth := 0
+	for {
+		tok := lx.next()
+		if tok.kind == tEOF {
+			return 0, errors.New("unexpected end of input looking for a declaration body")
+		}
+		switch tok.text {
+		case "(", "[":
+			parenDepth++
+		case ")", "]":
+			parenDepth--
+		case "{":
+			if parenDepth == 0 {
+				return scanBraceBody(lx)
+			}
+		}
+	}
+}
+
+// scanBraceBody balances the "{" lx has just consumed against its matching
+// "}", returning the offset right after it.
+func scanBraceBody(lx *lexer) (int, error) {
+	depth := 1
+	for {
+		tok := lx.next()
+		if tok.kind == tEOF {
+			return 0, errors.New("unexpected end of input inside a declaration body")
+		}
+		switch tok.text {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		}
+		if depth == 0 {
+			return tok.end, nil
+		}
+	}
+}
+
+// consumeOptionalSemicolon consumes lx's next token if it's a semicolon,
+// returning its end offset; otherwise it pushes the token back and returns
+// fallback unchanged.
+func consumeOptionalSemicolon(lx *lexer, fallback int) int {
+	t := lx.next()
+	if t.text == ";" {
+		return t.end
+	}
+	lx.unread(t)
+	return fallback
+}
+
+// decodeStringLiteral strips lit's surrounding quotes and unescapes the
+// handful of escape sequences that realistically show up in a module
+// specifier; it isn't a general-purpose JS string literal decoder.
+func decodeStringLiteral(lit string) string {
+	if len(lit) < 2 {
+		return lit
+	}
+	body := lit[1 : len(lit)-1]
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c == '\\' && i+1 < len(body) {
+			i++
+			switch body[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(body[i])
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,191 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package compiler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsModuleOnlyTrueForTopLevelImportExport(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want bool
+	}{
+		{"commonjs", `var x = require("./foo");`, false},
+		{"import", `import foo from './foo.js';`, true},
+		{"export", `export const x = 1;`, true},
+		{"property named import", `var x = foo.import;`, false},
+		{"import inside string", `var x = "import foo from './foo.js'";`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsModule(tt.src); got != tt.want {
+				t.Errorf("IsModule(%q) = %v, want %v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDesugarModuleStripsImportsAndRecordsBindings(t *testing.T) {
+	src := `import foo from './foo.js';
+import { bar } from './bar.js';
+console.log(foo, bar);
+`
+	out, imports, _, err := DesugarModule(src, "test.js")
+	if err != nil {
+		t.Fatalf("DesugarModule: %v", err)
+	}
+
+	if IsModule(out) {
+		t.Fatalf("desugared output still looks like a module:\n%s", out)
+	}
+	if len(imports) != 2 {
+		t.Fatalf("expected 2 imports, got %d: %+v", len(imports), imports)
+	}
+	if imports[0].Source != "./foo.js" || imports[0].Bindings[0] != (ImportBinding{Local: "foo", Imported: ImportedDefault}) {
+		t.Errorf("unexpected first import: %+v", imports[0])
+	}
+	if imports[1].Source != "./bar.js" || imports[1].Bindings[0] != (ImportBinding{Local: "bar", Imported: "bar"}) {
+		t.Errorf("unexpected second import: %+v", imports[1])
+	}
+}
+
+func TestDesugarModuleRejectsReExport(t *testing.T) {
+	src := `export { a } from './a.js';`
+	if _, _, _, err := DesugarModule(src, "test.js"); err == nil {
+		t.Fatalf("expected DesugarModule to reject `export ... from`, got no error")
+	}
+}
+
+func TestDesugarModuleRewritesExportsOntoExportsObject(t *testing.T) {
+	src := `export const answer = 42;
+export default function main() {}
+`
+	out, _, _, err := DesugarModule(src, "test.js")
+	if err != nil {
+		t.Fatalf("DesugarModule: %v", err)
+	}
+
+	if IsModule(out) {
+		t.Fatalf("desugared output still looks like a module:\n%s", out)
+	}
+	if _, err := Parse(out, "test.js"); err != nil {
+		t.Fatalf("desugared output doesn't parse: %v\n%s", err, out)
+	}
+}
+
+func TestDesugarModuleHandlesDefaultExportedClosureCalledLater(t *testing.T) {
+	// The pattern every real k6 script uses: a default-exported function
+	// that references an import, called well after the module's own body
+	// has finished running.
+	src := `import { sleep } from './helper.js';
+export default function() {
+	sleep(1);
+}
+`
+	out, imports, _, err := DesugarModule(src, "test.js")
+	if err != nil {
+		t.Fatalf("DesugarModule: %v", err)
+	}
+	if len(imports) != 1 || imports[0].Bindings[0].Local != "sleep" {
+		t.Fatalf("unexpected imports: %+v", imports)
+	}
+	if _, err := Parse(out, "test.js"); err != nil {
+		t.Fatalf("desugared output doesn't parse: %v\n%s", err, out)
+	}
+}
+
+func TestDesugarModuleRejectsReExportAll(t *testing.T) {
+	src := `export * from './a.js';`
+	if _, _, _, err := DesugarModule(src, "test.js"); err == nil {
+		t.Fatalf("expected DesugarModule to reject `export * from`, got no error")
+	}
+}
+
+func TestDesugarModuleNamedExportWithoutDeclaration(t *testing.T) {
+	src := `const a = 1;
+export { a as b };
+`
+	out, _, _, err := DesugarModule(src, "test.js")
+	if err != nil {
+		t.Fatalf("DesugarModule: %v", err)
+	}
+	outProg, err := Parse(out, "test.js")
+	if err != nil {
+		t.Fatalf("desugared output doesn't parse: %v\n%s", err, out)
+	}
+	if outProg == nil {
+		t.Fatalf("desugared output isn't valid ES5:\n%s", out)
+	}
+}
+
+func TestWrapModuleBodyProducesAFunctionTakingParams(t *testing.T) {
+	out, _ := WrapModuleBody("test.js", "exports.answer = 42;", nil, []string{"foo", "bar"})
+
+	prog, err := Parse(out, "test.js")
+	if err != nil || prog == nil {
+		t.Fatalf("wrapped output doesn't parse: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "function(foo, bar)") {
+		t.Errorf("expected params foo, bar in the wrapper signature, got:\n%s", out)
+	}
+}
+
+func TestWrapModuleBodyShiftsSourceMapByOneLine(t *testing.T) {
+	src := `import { a } from './a.js';
+export const b = a;
+`
+	body, _, bodyMap, err := DesugarModule(src, "test.js")
+	if err != nil {
+		t.Fatalf("DesugarModule: %v", err)
+	}
+
+	_, wrappedMap := WrapModuleBody("test.js", body, bodyMap, []string{"a"})
+
+	// The wrapper's own opening line has no real counterpart, so it's
+	// attributed to src's first line same as any other boilerplate
+	// DesugarModule inserts; every line of body, now one generated line
+	// further down, should still trace back to the same original line.
+	for genLine := 2; genLine <= len(wrappedMap.mappings); genLine++ {
+		_, wantLine, _, ok := bodyMap.Original(genLine-1, 0)
+		if !ok {
+			continue
+		}
+		_, gotLine, _, ok := wrappedMap.Original(genLine, 0)
+		if !ok || gotLine != wantLine {
+			t.Errorf("wrappedMap.Original(%d, 0) = (line %d, ok=%v), want (line %d, ok=true)", genLine, gotLine, ok, wantLine)
+		}
+	}
+}
+
+func TestWrapModuleBodyBuildsAnIdentitySourceMapWhenBodyWasUnrewritten(t *testing.T) {
+	body := "var x = 1;\nvar y = 2;\n"
+	_, wrappedMap := WrapModuleBody("test.js", body, nil, nil)
+
+	if _, line, _, ok := wrappedMap.Original(2, 0); !ok || line != 1 {
+		t.Errorf("Original(2, 0) = (line %d, ok=%v), want (line 1, ok=true)", line, ok)
+	}
+	if _, line, _, ok := wrappedMap.Original(3, 0); !ok || line != 2 {
+		t.Errorf("Original(3, 0) = (line %d, ok=%v), want (line 2, ok=true)", line, ok)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package compiler
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// SourceMap relates positions in a transformed source back to positions in
+// the original, pre-transform source. The only thing that currently builds
+// one is DesugarModule's ES-module rewrite (see module.go); Transform's
+// Babel path doesn't produce one yet, since no Babel bridge is wired up at
+// all (see babel.go).
+type SourceMap struct {
+	File    string
+	Sources []string
+
+	mappings [][]sourceMapping
+}
+
+type sourceMapping struct {
+	genCol    int
+	sourceIdx int
+	srcLine   int
+	srcCol    int
+}
+
+// Original maps a 1-based (line, col) position in the transformed source
+// back to its 1-based position in the original source with a linear scan
+// over that line's mappings, returning ok=false if line/col falls outside
+// any recorded mapping.
+func (sm *SourceMap) Original(line, col int) (file string, origLine, origCol int, ok bool) {
+	if sm == nil || line < 1 || line > len(sm.mappings) {
+		return "", 0, 0, false
+	}
+	row := sm.mappings[line-1]
+
+	best := -1
+	for idx, m := range row {
+		if m.genCol > col {
+			break
+		}
+		best = idx
+	}
+	if best == -1 {
+		return "", 0, 0, false
+	}
+
+	m := row[best]
+	file = sm.File
+	if m.sourceIdx >= 0 && m.sourceIdx < len(sm.Sources) {
+		file = sm.Sources[m.sourceIdx]
+	}
+	return file, m.srcLine + 1, m.srcCol + 1, true
+}
+
+// sourceMapWireMapping mirrors sourceMapping with exported fields, purely so
+// GobEncode/GobDecode have something gob can see into - sourceMapping itself
+// stays unexported since Original is the only thing that needs to read it.
+type sourceMapWireMapping struct {
+	GenCol, SourceIdx, SrcLine, SrcCol int
+}
+
+// GobEncode implements gob.GobEncoder. mappings is unexported, so without
+// this SourceMap would gob-encode as File/Sources only, silently dropping
+// the lookup table Original needs - the same class of bug as trying to
+// gob-encode *goja.Program directly.
+func (sm *SourceMap) GobEncode() ([]byte, error) {
+	wire := make([][]sourceMapWireMapping, len(sm.mappings))
+	for i, row := range sm.mappings {
+		wireRow := make([]sourceMapWireMapping, len(row))
+		for j, m := range row {
+			wireRow[j] = sourceMapWireMapping{m.genCol, m.sourceIdx, m.srcLine, m.srcCol}
+		}
+		wire[i] = wireRow
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(struct {
+		File     string
+		Sources  []string
+		Mappings [][]sourceMapWireMapping
+	}{sm.File, sm.Sources, wire})
+	return buf.Bytes(), err
+}
+
+// GobDecode implements gob.GobDecoder, the inverse of GobEncode.
+func (sm *SourceMap) GobDecode(data []byte) error {
+	var wire struct {
+		File     string
+		Sources  []string
+		Mappings [][]sourceMapWireMapping
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&wire); err != nil {
+		return err
+	}
+
+	mappings := make([][]sourceMapping, len(wire.Mappings))
+	for i, row := range wire.Mappings {
+		mappingsRow := make([]sourceMapping, len(row))
+		for j, m := range row {
+			mappingsRow[j] = sourceMapping{genCol: m.GenCol, sourceIdx: m.SourceIdx, srcLine: m.SrcLine, srcCol: m.SrcCol}
+		}
+		mappings[i] = mappingsRow
+	}
+
+	sm.File = wire.File
+	sm.Sources = wire.Sources
+	sm.mappings = mappings
+	return nil
+}
@@ -24,6 +24,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 
 	"github.com/dop251/goja"
@@ -37,6 +38,12 @@ import (
 type programWithSource struct {
 	pgm *goja.Program
 	src string
+	// srcMap relates positions in src (the source that was actually
+	// compiled) back to positions in the original file, so runtime errors
+	// can be reported at a location the user recognizes. Only ES modules
+	// (desugared and wrapped, see linkModule) carry one; it's nil for
+	// CommonJS files, since compiler.Transform returns no source map.
+	srcMap *compiler.SourceMap
 }
 
 // Provides APIs for use in the init context.
@@ -48,26 +55,54 @@ type InitContext struct {
 	ctxPtr *context.Context
 
 	// Filesystem to load files and scripts from.
-	fs  afero.Fs
-	pwd string
+	fs afero.Fs
+	// pwd is the base relative imports are resolved against. It is a
+	// *url.URL, not a filesystem path, so that a module loaded from a
+	// remote origin can resolve its own relative imports against that
+	// origin rather than the local working directory.
+	pwd *url.URL
 
 	// Cache of loaded programs and files.
 	programs map[string]programWithSource
 	files    map[string][]byte
+	// Cache of linked ES module records, keyed by their resolved URL.
+	modules map[string]*moduleRecord
+	// Disk-backed second-level cache of compiled programs, keyed by source
+	// hash rather than filename, so it survives across separate `k6 run`s.
+	progCache *diskProgramCache
+	// Cache of parsed package.json files, consulted while resolving bare
+	// specifiers (`require("lodash")`) against node_modules.
+	packages map[string]*loader.PackageJSON
+	// specifierAliases maps a bare specifier (`require("lodash")`'s
+	// argument, not a path) straight to the resolved URL it was recorded
+	// under, bypassing node_modules resolution entirely. Only populated
+	// when rehydrated from a bundle archive (see NewInitContextFromArchive)
+	// - the archive's filesystem doesn't mirror a real node_modules tree
+	// for ResolveNodeModule to walk, so resolution has to be skipped rather
+	// than repeated.
+	specifierAliases map[string]string
+
+	// recorder, when set, captures every requireFile/Open this context
+	// makes into a bundle archive (see NewRecordingInitContext).
+	recorder *loader.ArchiveWriter
 
 	// Console object.
 	Console *Console
 }
 
-func NewInitContext(rt *goja.Runtime, ctxPtr *context.Context, fs afero.Fs, pwd string) *InitContext {
+func NewInitContext(rt *goja.Runtime, ctxPtr *context.Context, fs afero.Fs, pwd *url.URL) *InitContext {
 	return &InitContext{
 		runtime: rt,
 		ctxPtr:  ctxPtr,
 		fs:      fs,
 		pwd:     pwd,
 
-		programs: make(map[string]programWithSource),
-		files:    make(map[string][]byte),
+		programs:         make(map[string]programWithSource),
+		files:            make(map[string][]byte),
+		modules:          make(map[string]*moduleRecord),
+		progCache:        newDiskProgramCache(),
+		packages:         make(map[string]*loader.PackageJSON),
+		specifierAliases: make(map[string]string),
 
 		Console: NewConsole(),
 	}
@@ -81,8 +116,13 @@ func newBoundInitContext(base *InitContext, ctxPtr *context.Context, rt *goja.Ru
 		fs:  nil,
 		pwd: base.pwd,
 
-		programs: base.programs,
-		files:    base.files,
+		programs:         base.programs,
+		files:            base.files,
+		modules:          base.modules,
+		progCache:        base.progCache,
+		packages:         base.packages,
+		specifierAliases: base.specifierAliases,
+		recorder:         base.recorder,
 
 		Console: base.Console,
 	}
@@ -117,10 +157,78 @@ func (i *InitContext) requireModule(name string) (goja.Value, error) {
 }
 
 func (i *InitContext) requireFile(name string) (goja.Value, error) {
-	// Resolve the file path, push the target directory as pwd to make relative imports work.
+	// Resolve the module path/URL, push the target directory as pwd to make relative imports work.
 	pwd := i.pwd
-	filename := loader.Resolve(pwd, name)
-	i.pwd = loader.Dir(filename)
+	var fileURL *url.URL
+	var err error
+	if target, ok := i.specifierAliases[name]; ok {
+		fileURL, err = url.Parse(target)
+	} else {
+		fileURL, err = loader.Resolve(i.fs, i.packages, pwd, name)
+	}
+	if err != nil {
+		return goja.Undefined(), err
+	}
+	filename := fileURL.String()
+
+	if i.recorder != nil && loader.IsBareSpecifier(name) {
+		// The recorded archive's filesystem won't have a node_modules tree
+		// for ResolveNodeModule to walk on replay, so save it the trouble:
+		// alias the bare specifier straight to what it resolved to here.
+		i.recorder.Alias(name, filename)
+	}
+
+	// Native ES modules (import/export) go through a separate link+evaluate
+	// pipeline; only fall through to the CommonJS path below for scripts
+	// that don't use that syntax.
+	if mr, ok := i.modules[filename]; ok {
+		if err := i.evaluateModule(mr); err != nil {
+			return goja.Undefined(), err
+		}
+		return mr.namespace, nil
+	}
+
+	// Read the source once for a CommonJS script - loader.Load may hit the
+	// network (for a remote module) or at least the filesystem. An ES module
+	// is handed on to requireESM, whose linkModule loads it a second time
+	// (for a remote module, from the on-disk cache the first load filled).
+	pgm, ok := i.programs[filename]
+	if !ok {
+		data, err := loader.Load(i.fs, fileURL, name)
+		if err != nil {
+			return goja.Undefined(), err
+		}
+		rawSrc := string(data.Data)
+
+		if compiler.IsModule(rawSrc) {
+			return i.requireESM(name)
+		}
+
+		// Keyed off the raw, pre-transform source: a hit skips
+		// compiler.Transform entirely (and any Babel invocation it would've
+		// made), which is the expensive part this cache exists to avoid.
+		// goja.Compile still has to run on every hit, cached or not -
+		// goja.Program itself can't be persisted, only the source it was
+		// compiled from.
+		if cached, ok := i.progCache.Get(rawSrc); ok {
+			pgm = cached
+		} else {
+			src, srcMap, err := compiler.Transform(rawSrc, data.Filename)
+			if err != nil {
+				return goja.Undefined(), err
+			}
+			pgm_, err := goja.Compile(data.Filename, src, true)
+			if err != nil {
+				return goja.Undefined(), err
+			}
+			pgm = programWithSource{pgm_, src, srcMap}
+			i.progCache.Put(data.Filename, rawSrc, pgm)
+		}
+		i.programs[filename] = pgm
+		i.recordModule(filename, pgm)
+	}
+
+	i.pwd = loader.Dir(fileURL)
 	defer func() { i.pwd = pwd }()
 
 	// Swap the importing scope's imports out, then put it back again.
@@ -135,29 +243,10 @@ func (i *InitContext) requireFile(name string) (goja.Value, error) {
 	_ = module.Set("exports", exports)
 	i.runtime.Set("module", module)
 
-	// Read sources, transform into ES6 and cache the compiled program.
-	pgm, ok := i.programs[filename]
-	if !ok {
-		data, err := loader.Load(i.fs, pwd, name)
-		if err != nil {
-			return goja.Undefined(), err
-		}
-		src, _, err := compiler.Transform(string(data.Data), data.Filename)
-		if err != nil {
-			return goja.Undefined(), err
-		}
-		pgm_, err := goja.Compile(data.Filename, src, true)
-		if err != nil {
-			return goja.Undefined(), err
-		}
-		pgm = programWithSource{pgm_, src}
-		i.programs[filename] = pgm
-	}
-
 	// Execute the program to populate exports. You may notice that this theoretically allows an
 	// imported file to access or overwrite globals defined outside of it. Please don't do anything
 	// stupid with this, consider *any* use of it undefined behavior >_>;;
-	if _, err := i.runtime.RunProgram(pgm.pgm); err != nil {
+	if _, err := i.runProgram(pgm.pgm, pgm.srcMap); err != nil {
 		return goja.Undefined(), err
 	}
 
@@ -165,15 +254,20 @@ func (i *InitContext) requireFile(name string) (goja.Value, error) {
 }
 
 func (i *InitContext) Open(name string) (string, error) {
-	filename := loader.Resolve(i.pwd, name)
+	fileURL, err := loader.Resolve(i.fs, i.packages, i.pwd, name)
+	if err != nil {
+		return "", err
+	}
+	filename := fileURL.String()
 	data, ok := i.files[filename]
 	if !ok {
-		data_, err := loader.Load(i.fs, i.pwd, name)
+		data_, err := loader.Load(i.fs, fileURL, name)
 		if err != nil {
 			return "", err
 		}
 		i.files[filename] = data_.Data
 		data = data_.Data
+		i.recordOpen(filename, data)
 	}
 	return string(data), nil
 }
@@ -0,0 +1,294 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package js
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/loadimpact/k6/js/compiler"
+	"github.com/loadimpact/k6/loader"
+	"github.com/pkg/errors"
+)
+
+// moduleDependency is one dependency a module imports, together with the
+// bindings (if any) that import introduces into the importing module's
+// scope once the dependency has been evaluated.
+type moduleDependency struct {
+	url      string
+	bindings []compiler.ImportBinding
+}
+
+// moduleRecord is the linking-time representation of a native ES module:
+// its own compiled program, the dependencies it imports (and what each one
+// binds), and the namespace object import statements elsewhere end up bound
+// to.
+//
+// The namespace object is created up front, before the module (or any of
+// its dependencies) is evaluated, so that an import forming part of a cycle
+// observes the partially-initialized namespace instead of deadlocking.
+//
+// A builtin dependency ("k6" or "k6/...") gets a moduleRecord too, rather
+// than its own code path: it's created already evaluated, with no
+// dependencies of its own and namespace set to whatever requireModule
+// returns, so the rest of linking/evaluation doesn't need to know built-in
+// and file-based modules apart. isBuiltin only matters for one thing - see
+// moduleArgs.
+type moduleRecord struct {
+	url          string
+	dependencies []moduleDependency
+	pgm          *goja.Program
+	srcMap       *compiler.SourceMap
+	namespace    *goja.Object
+	evaluating   bool
+	evaluated    bool
+	isBuiltin    bool
+}
+
+// builtinModuleKey returns the key a builtin dependency is registered
+// under in InitContext.modules - namespaced so "k6/http" can never collide
+// with a same-named file resolved to a real URL.
+func builtinModuleKey(name string) string {
+	return "builtin:" + name
+}
+
+// isBuiltinModuleSpecifier reports whether name is one of the "k6"/"k6/..."
+// specifiers Require already special-cases for CommonJS - see
+// InitContext.Require.
+func isBuiltinModuleSpecifier(name string) bool {
+	return name == "k6" || strings.HasPrefix(name, "k6/")
+}
+
+// linkBuiltinModule registers (if not already registered) a moduleRecord
+// for the builtin module name, so an ES module that imports it resolves
+// the same "k6"/"k6/..." names CommonJS's require() does, instead of being
+// routed into ResolveNodeModule - which would walk node_modules looking for
+// a literal "k6/http" package and always fail.
+func (i *InitContext) linkBuiltinModule(name string) error {
+	key := builtinModuleKey(name)
+	if _, ok := i.modules[key]; ok {
+		return nil
+	}
+	v, err := i.requireModule(name)
+	if err != nil {
+		return err
+	}
+	i.modules[key] = &moduleRecord{
+		url:       key,
+		namespace: v.ToObject(i.runtime),
+		evaluated: true,
+		isBuiltin: true,
+	}
+	return nil
+}
+
+// requireESM resolves and evaluates the ES module named by name relative to
+// the importing file's pwd, returning its namespace object.
+func (i *InitContext) requireESM(name string) (goja.Value, error) {
+	u, err := loader.Resolve(i.fs, i.packages, i.pwd, name)
+	if err != nil {
+		return goja.Undefined(), err
+	}
+
+	mr, err := i.linkModule(u, name)
+	if err != nil {
+		return goja.Undefined(), err
+	}
+	if err := i.evaluateModule(mr); err != nil {
+		return goja.Undefined(), err
+	}
+	return mr.namespace, nil
+}
+
+// linkModule implements the "resolve all dependencies, then instantiate"
+// half of module linking: it loads, parses and desugars name (and,
+// recursively, every module it imports), registering a moduleRecord - with
+// an empty namespace object already in place - for each one before
+// anything is evaluated.
+func (i *InitContext) linkModule(u *url.URL, name string) (*moduleRecord, error) {
+	key := u.String()
+	if mr, ok := i.modules[key]; ok {
+		// Already linked (or in the process of being linked, for a cyclic
+		// import) - the namespace object below is already registered.
+		return mr, nil
+	}
+
+	if i.recorder != nil {
+		// A recording InitContext only archives the flattened, desugared
+		// program (see recordModule) - none of what moduleArgs needs to
+		// make an import resolve to anything (the dependency graph, and
+		// which names each module binds from which) is persisted, so a
+		// bundle built from an ES-module script would replay into
+		// ReferenceErrors for every import. Reject it here instead of
+		// producing an archive that looks fine until it's run.
+		return nil, errors.Errorf(
+			"%s: bundling scripts that use ES modules (import/export) isn't supported yet; "+
+				"use `k6 run` directly instead of `k6 bundle`", name)
+	}
+
+	data, err := loader.Load(i.fs, u, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// DesugarModule both strips the import/export syntax goja can't execute
+	// on its own and tells us what this module imports - there's no
+	// separate Transform pass for ES modules, since import/export is
+	// already the one thing here goja's own parser can't even parse, let
+	// alone compile (see IsModule).
+	src, imports, srcMap, err := compiler.DesugarModule(string(data.Data), data.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var params []string
+	for _, imp := range imports {
+		for _, b := range imp.Bindings {
+			params = append(params, b.Local)
+		}
+	}
+	wrapped, srcMap := compiler.WrapModuleBody(data.Filename, src, srcMap, params)
+	pgm, err := goja.Compile(data.Filename, wrapped, true)
+	if err != nil {
+		return nil, err
+	}
+
+	mr := &moduleRecord{
+		url:       key,
+		pgm:       pgm,
+		srcMap:    srcMap,
+		namespace: i.runtime.NewObject(),
+	}
+	// Register before recursing into dependencies, so a cycle back to this
+	// module finds the (still empty) namespace instead of relinking it.
+	i.modules[key] = mr
+	i.recordModule(key, programWithSource{pgm: pgm, src: wrapped, srcMap: srcMap})
+
+	base := i.pwd
+	i.pwd = loader.Dir(u)
+	for _, imp := range imports {
+		if isBuiltinModuleSpecifier(imp.Source) {
+			// Builtins don't exist on the filesystem - ResolveNodeModule
+			// would walk node_modules looking for a literal "k6/http"
+			// package and always fail. Route them the same way Require
+			// already does for CommonJS instead of resolving them at all.
+			if err := i.linkBuiltinModule(imp.Source); err != nil {
+				i.pwd = base
+				return nil, err
+			}
+			mr.dependencies = append(mr.dependencies, moduleDependency{
+				url: builtinModuleKey(imp.Source), bindings: imp.Bindings,
+			})
+			continue
+		}
+
+		depURL, err := loader.Resolve(i.fs, i.packages, i.pwd, imp.Source)
+		if err != nil {
+			i.pwd = base
+			return nil, err
+		}
+		if _, err := i.linkModule(depURL, imp.Source); err != nil {
+			i.pwd = base
+			return nil, err
+		}
+		mr.dependencies = append(mr.dependencies, moduleDependency{url: depURL.String(), bindings: imp.Bindings})
+	}
+	i.pwd = base
+
+	return mr, nil
+}
+
+// evaluateModule runs a linked module's body, after first evaluating every
+// module it depends on and instantiating the bindings those dependencies
+// introduce. Already-evaluated and currently-evaluating modules (the latter
+// only possible via an import cycle) are no-ops, so a cycle unwinds cleanly
+// instead of recursing forever.
+func (i *InitContext) evaluateModule(mr *moduleRecord) error {
+	if mr.evaluated || mr.evaluating {
+		return nil
+	}
+	mr.evaluating = true
+	defer func() { mr.evaluating = false }()
+
+	for _, dep := range mr.dependencies {
+		depMr, ok := i.modules[dep.url]
+		if !ok {
+			return errors.Errorf("module %s: dependency %s was never linked", mr.url, dep.url)
+		}
+		if err := i.evaluateModule(depMr); err != nil {
+			return err
+		}
+	}
+
+	// mr.pgm is DesugarModule's output wrapped in a function literal (see
+	// compiler.WrapModuleBody) taking mr's imports as parameters, so running
+	// it just evaluates to that function - nothing in the module body
+	// actually executes until it's called below, with each import's
+	// resolved value passed positionally.
+	v, err := i.runProgram(mr.pgm, mr.srcMap)
+	if err != nil {
+		return err
+	}
+	fn, ok := goja.AssertFunction(v)
+	if !ok {
+		return errors.Errorf("module %s: expected DesugarModule's output to compile to a function, got %T", mr.url, v)
+	}
+
+	// Run the module body with "exports" bound to its namespace object, the
+	// same protocol DesugarModule rewrites `export` statements into.
+	oldExports := i.runtime.Get("exports")
+	defer i.runtime.Set("exports", oldExports)
+	i.runtime.Set("exports", mr.namespace)
+
+	if _, err := fn(goja.Undefined(), i.moduleArgs(mr)...); err != nil {
+		return remapException(err, mr.srcMap)
+	}
+	mr.evaluated = true
+	return nil
+}
+
+// moduleArgs resolves the value each of mr's dependencies binds, in the same
+// order compiler.WrapModuleBody was given their local names when mr.pgm was
+// compiled - real, positional function arguments, rather than properties on
+// the runtime's shared global object that a second module importing
+// something under the same local name would silently overwrite.
+func (i *InitContext) moduleArgs(mr *moduleRecord) []goja.Value {
+	var args []goja.Value
+	for _, dep := range mr.dependencies {
+		depMr := i.modules[dep.url]
+		for _, b := range dep.bindings {
+			switch {
+			case b.Imported == compiler.ImportedNamespace:
+				args = append(args, depMr.namespace)
+			case b.Imported == compiler.ImportedDefault && depMr.isBuiltin:
+				// Builtin modules have no "default" export of their own;
+				// `import http from 'k6/http'` binds the whole module
+				// object, the same CommonJS-interop convention bundlers use
+				// for a module with no __esModule marker.
+				args = append(args, depMr.namespace)
+			default:
+				args = append(args, depMr.namespace.Get(b.Imported))
+			}
+		}
+	}
+	return args
+}
@@ -0,0 +1,89 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package js
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/spf13/afero"
+)
+
+// TestRequireESMBindsImportsPerModule reproduces a bug where two modules
+// that each import a different dependency under the same local name
+// ("helper") clobbered each other: imports used to be installed as accessor
+// properties on the runtime's shared global object rather than in a scope
+// private to the importing module, so linking the second module silently
+// overwrote the first's "helper" binding - and since the getter resolved
+// lazily, a closure from the first module that referenced "helper" later
+// (the universal `export default function() {...}` pattern) would silently
+// start calling the second module's dependency instead of its own.
+func TestRequireESMBindsImportsPerModule(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	files := map[string]string{
+		"/helper_a.js": `export default function() { return "a"; };`,
+		"/helper_b.js": `export default function() { return "b"; };`,
+		"/m1.js": `import helper from './helper_a.js';
+export default function() { return helper(); };`,
+		"/m2.js": `import helper from './helper_b.js';
+export default function() { return helper(); };`,
+	}
+	for name, src := range files {
+		if err := afero.WriteFile(fs, name, []byte(src), 0o644); err != nil {
+			t.Fatalf("WriteFile(%s): %v", name, err)
+		}
+	}
+
+	rt := goja.New()
+	ctxPtr := new(context.Context)
+	*ctxPtr = context.Background()
+	i := NewInitContext(rt, ctxPtr, fs, &url.URL{Scheme: "file", Path: "/"})
+
+	m1, err := i.requireFile("./m1.js")
+	if err != nil {
+		t.Fatalf("requireFile(m1.js): %v", err)
+	}
+	m2, err := i.requireFile("./m2.js")
+	if err != nil {
+		t.Fatalf("requireFile(m2.js): %v", err)
+	}
+
+	callDefault := func(v goja.Value, name string) string {
+		fn, ok := goja.AssertFunction(v.ToObject(rt).Get("default"))
+		if !ok {
+			t.Fatalf("%s: default export isn't callable", name)
+		}
+		res, err := fn(goja.Undefined())
+		if err != nil {
+			t.Fatalf("%s: calling default export: %v", name, err)
+		}
+		return res.String()
+	}
+
+	if got := callDefault(m1, "m1.js"); got != "a" {
+		t.Errorf(`m1.js's default export returned %q, want "a" - its "helper" import was clobbered by m2.js's`, got)
+	}
+	if got := callDefault(m2, "m2.js"); got != "b" {
+		t.Errorf(`m2.js's default export returned %q, want "b"`, got)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package js
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+
+	"github.com/dop251/goja"
+	"github.com/loadimpact/k6/js/compiler"
+	"github.com/loadimpact/k6/lib/consts"
+)
+
+// progCacheFormatVersion is bumped whenever the on-disk entry layout
+// changes in a way that isn't otherwise captured by the k6 version, so old
+// entries are ignored rather than failing to gob-decode.
+const progCacheFormatVersion = 1
+
+// progCacheEntry is the gob-encoded payload stored for each cached program.
+// goja.Program has no exported fields (and no Gob(En|De)code of its own), so
+// it can't be the thing that's actually persisted here; Filename, Source
+// (already transformed) and SrcMap are, and Get recompiles the program from
+// Source on every disk-cache hit instead.
+type progCacheEntry struct {
+	Filename string
+	Source   string
+	SrcMap   *compiler.SourceMap
+}
+
+// diskProgramCache is a disk-backed cache of a test suite's transformed
+// sources, content-addressed by their *pre-transform* source, so a repeat
+// `k6 run` skips compiler.Transform entirely on a hit (re-parsing, and
+// Babel for anything that needed it) - that's the expensive part this
+// cache exists to avoid. goja.Compile still has to run again on every hit
+// regardless, since goja.Program itself can't be persisted; only the
+// source it was compiled from (and the source map alongside it) can. A
+// small in-process LRU sits in front of it, holding the actual compiled
+// programs, so re-require()ing the same file within one run doesn't even
+// pay for that.
+type diskProgramCache struct {
+	dir string
+	// gojaVersion is mixed into key so a goja upgrade - which can change how
+	// the cached (already-transformed) source compiles - invalidates old entries
+	// instead of reusing them under a new goja that disagrees about them.
+	gojaVersion string
+
+	mu  sync.Mutex
+	lru map[string]programWithSource
+	// order tracks LRU recency, most-recently-used last.
+	order []string
+}
+
+const progCacheLRUSize = 64
+
+func newDiskProgramCache() *diskProgramCache {
+	dir, err := progCacheDir()
+	if err != nil {
+		// A cache we can't locate is equivalent to a cache that's always
+		// empty: callers fall back to compiling from source.
+		dir = ""
+	}
+	return &diskProgramCache{
+		dir:         dir,
+		gojaVersion: gojaVersion(),
+		lru:         make(map[string]programWithSource),
+	}
+}
+
+// gojaVersion returns the resolved version of the github.com/dop251/goja
+// dependency this binary was built against, or "unknown" if build info
+// isn't available (e.g. a binary built without module mode).
+func gojaVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != "github.com/dop251/goja" {
+			continue
+		}
+		if dep.Replace != nil {
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return "unknown"
+}
+
+// progCacheDir returns the directory compiled programs are cached under,
+// overridable through K6_COMPILE_CACHE_DIR.
+func progCacheDir() (string, error) {
+	if dir := os.Getenv("K6_COMPILE_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "k6", "progcache"), nil
+}
+
+// key derives the cache entry name for a piece of raw, pre-transform
+// source: its own hash, salted with the goja version, the k6 version and
+// the cache format version, so upgrading any one of them invalidates old
+// entries instead of misreading them.
+func (c *diskProgramCache) key(rawSrc string) string {
+	h := sha256.New()
+	_, _ = h.Write([]byte(rawSrc))
+	_, _ = h.Write([]byte(c.gojaVersion))
+	_, _ = h.Write([]byte(consts.Version))
+	_, _ = h.Write([]byte{byte(progCacheFormatVersion)})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the cached program for rawSrc, if any, recompiling it from
+// the cached (already-transformed) source - under its originally-cached
+// filename - on a disk hit; the bytecode itself never round-trips through
+// disk, but compiler.Transform and its own Babel invocation are skipped
+// entirely.
+func (c *diskProgramCache) Get(rawSrc string) (programWithSource, bool) {
+	key := c.key(rawSrc)
+
+	c.mu.Lock()
+	if entry, ok := c.lru[key]; ok {
+		c.touch(key)
+		c.mu.Unlock()
+		return entry, true
+	}
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return programWithSource{}, false
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		return programWithSource{}, false
+	}
+	var entry progCacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&entry); err != nil {
+		return programWithSource{}, false
+	}
+	pgm, err := goja.Compile(entry.Filename, entry.Source, true)
+	if err != nil {
+		// A cache entry that no longer compiles shouldn't fail the run -
+		// just treat it as a miss and let the caller recompile from scratch.
+		return programWithSource{}, false
+	}
+	pws := programWithSource{pgm: pgm, src: entry.Source, srcMap: entry.SrcMap}
+
+	c.mu.Lock()
+	c.put(key, pws)
+	c.mu.Unlock()
+	return pws, true
+}
+
+// Put stores pws under rawSrc's key, both in the in-process LRU (the
+// compiled program itself) and on disk (its filename, transformed source
+// and source map, atomically, via write-to-temp-then-rename).
+func (c *diskProgramCache) Put(filename, rawSrc string, pws programWithSource) {
+	key := c.key(rawSrc)
+
+	c.mu.Lock()
+	c.put(key, pws)
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	entry := progCacheEntry{Filename: filename, Source: pws.src, SrcMap: pws.srcMap}
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return
+	}
+	_ = tmp.Close()
+	_ = os.Rename(tmp.Name(), filepath.Join(c.dir, key))
+}
+
+// put records key -> pws as the most-recently-used entry, evicting the
+// least-recently-used one if the in-process cache is full. Callers must
+// hold c.mu.
+func (c *diskProgramCache) put(key string, pws programWithSource) {
+	if _, ok := c.lru[key]; !ok && len(c.order) >= progCacheLRUSize {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.lru, oldest)
+	}
+	c.lru[key] = pws
+	c.touch(key)
+}
+
+// touch moves key to the most-recently-used end of c.order. Callers must
+// hold c.mu.
+func (c *diskProgramCache) touch(key string) {
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, key)
+}
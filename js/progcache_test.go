@@ -0,0 +1,110 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package js
+
+import (
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/loadimpact/k6/js/compiler"
+)
+
+// TestDiskProgramCacheRoundTrip exercises a Put followed by a Get against a
+// cold in-process LRU (simulating a separate process reading back the disk
+// cache), checking that the program it returns still actually runs - rather
+// than, say, the zero-value *goja.Program a naive gob round trip of the
+// unexported type would produce - and that its source map survives the trip
+// too.
+func TestDiskProgramCacheRoundTrip(t *testing.T) {
+	// DesugarModule is the one production code path that actually builds a
+	// *compiler.SourceMap (compiler.Transform's Babel path doesn't emit one
+	// yet - see babel.go), so use it here rather than hand-assembling one.
+	const rawSrc = "export const answer = 42;\n"
+	transformed, _, srcMap, err := compiler.DesugarModule(rawSrc, "orig.js")
+	if err != nil {
+		t.Fatalf("DesugarModule: %v", err)
+	}
+	pgm, err := goja.Compile("test.js", transformed, true)
+	if err != nil {
+		t.Fatalf("goja.Compile: %v", err)
+	}
+
+	c := newDiskProgramCache()
+	c.dir = t.TempDir()
+	c.Put("test.js", rawSrc, programWithSource{pgm: pgm, src: transformed, srcMap: srcMap})
+
+	// Drop the in-process entry so Get is forced to go through the disk
+	// (and hence the gob encode/decode) path.
+	c.mu.Lock()
+	delete(c.lru, c.key(rawSrc))
+	c.order = nil
+	c.mu.Unlock()
+
+	got, ok := c.Get(rawSrc)
+	if !ok {
+		t.Fatalf("Get: expected a disk-cache hit")
+	}
+	if got.pgm == nil {
+		t.Fatalf("Get: returned a nil program")
+	}
+	if got.srcMap == nil {
+		t.Fatalf("Get: source map didn't survive the round trip")
+	}
+	if file, line, col, ok := got.srcMap.Original(1, 0); !ok || file != "orig.js" || line != 1 || col != 1 {
+		t.Errorf("Original(1, 0) = (%q, %d, %d, %v), want (\"orig.js\", 1, 1, true)", file, line, col, ok)
+	}
+
+	rt := goja.New()
+	exports := rt.NewObject()
+	rt.Set("exports", exports)
+	if _, err := rt.RunProgram(got.pgm); err != nil {
+		t.Fatalf("running the round-tripped program: %v", err)
+	}
+	if answer := exports.Get("answer"); answer == nil || answer.ToInteger() != 42 {
+		t.Errorf("expected exports.answer to be 42, got %v", answer)
+	}
+}
+
+// TestDiskProgramCacheKeyedByRawSource checks that Get is keyed off the
+// pre-transform source passed to Put, not whatever ends up in
+// programWithSource.src (which Transform may rewrite) - a hit has to be
+// found from the same raw source requireFile has on hand before it ever
+// calls Transform, or the whole point of this cache (skipping Transform)
+// doesn't work.
+func TestDiskProgramCacheKeyedByRawSource(t *testing.T) {
+	const rawSrc = "export const x = 1;"
+	const transformedSrc = "exports.x = 1;"
+	pgm, err := goja.Compile("test.js", transformedSrc, true)
+	if err != nil {
+		t.Fatalf("goja.Compile: %v", err)
+	}
+
+	c := newDiskProgramCache()
+	c.dir = t.TempDir()
+	c.Put("test.js", rawSrc, programWithSource{pgm: pgm, src: transformedSrc})
+
+	if _, ok := c.Get(transformedSrc); ok {
+		t.Fatalf("Get(transformedSrc) unexpectedly hit - cache isn't keyed by raw source")
+	}
+	if _, ok := c.Get(rawSrc); !ok {
+		t.Fatalf("Get(rawSrc): expected a hit")
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package js
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/dop251/goja"
+	"github.com/loadimpact/k6/js/compiler"
+)
+
+// stackFrameRE matches a "file:line:col" frame as it appears in a
+// goja.Exception's stack trace.
+var stackFrameRE = regexp.MustCompile(`([^\s()]+):(\d+):(\d+)`)
+
+// remappedError wraps a runtime error whose message and stack trace have
+// been translated from transformed-source coordinates back to the user's
+// original file, so k6's own error reporters can point at a location the
+// user actually wrote.
+type remappedError struct {
+	msg   string
+	stack string
+}
+
+func (e *remappedError) Error() string { return e.msg }
+
+// Stack returns the source-mapped stack trace, for reporters that know to
+// look for it (plain err.Error() already carries the remapped message).
+func (e *remappedError) Stack() string { return e.stack }
+
+// runProgram runs pgm, and - if it throws and srcMap is non-nil - remaps the
+// resulting exception's stack frames from transformed-source coordinates
+// back to positions in the original file before returning the error.
+func (i *InitContext) runProgram(pgm *goja.Program, srcMap *compiler.SourceMap) (goja.Value, error) {
+	v, err := i.runtime.RunProgram(pgm)
+	return v, remapException(err, srcMap)
+}
+
+// remapException is runProgram's remapping step, factored out so a module's
+// body - which, for an ES module, actually runs via a function call rather
+// than RunProgram itself (see js.InitContext.evaluateModule) - can apply the
+// same translation to errors thrown from that call.
+func remapException(err error, srcMap *compiler.SourceMap) error {
+	if err == nil || srcMap == nil {
+		return err
+	}
+
+	exc, ok := err.(*goja.Exception)
+	if !ok {
+		return err
+	}
+
+	return &remappedError{
+		msg:   remapStack(exc.Error(), srcMap),
+		stack: remapStack(exc.String(), srcMap),
+	}
+}
+
+// remapStack rewrites every "file:line:col" frame in raw using srcMap,
+// leaving frames it can't find a mapping for untouched.
+func remapStack(raw string, srcMap *compiler.SourceMap) string {
+	return stackFrameRE.ReplaceAllStringFunc(raw, func(frame string) string {
+		m := stackFrameRE.FindStringSubmatch(frame)
+		line, err := strconv.Atoi(m[2])
+		if err != nil {
+			return frame
+		}
+		col, err := strconv.Atoi(m[3])
+		if err != nil {
+			return frame
+		}
+
+		file, origLine, origCol, ok := srcMap.Original(line, col)
+		if !ok {
+			return frame
+		}
+		if file == "" {
+			file = m[1]
+		}
+		return fmt.Sprintf("%s:%d:%d", file, origLine, origCol)
+	})
+}
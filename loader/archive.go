@@ -0,0 +1,191 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const manifestPath = "manifest.json"
+
+// ArchiveEntryKind distinguishes the two things InitContext records while
+// running a script's init phase in bundling mode.
+type ArchiveEntryKind string
+
+const (
+	// ArchiveEntryModule captures a require()/import'd file: its transformed
+	// source and source map, stored gob-encoded at Path. The compiled program
+	// isn't stored; a reader recompiles it from that source.
+	ArchiveEntryModule ArchiveEntryKind = "module"
+	// ArchiveEntryOpen captures the raw bytes a call to open() returned.
+	ArchiveEntryOpen ArchiveEntryKind = "open"
+)
+
+// ArchiveEntry records where in the archive one recorded specifier's data
+// lives, and how to interpret it.
+type ArchiveEntry struct {
+	Kind ArchiveEntryKind `json:"kind"`
+	Path string           `json:"path"`
+}
+
+// ArchiveManifest is the bundle's index: which specifier (a resolved URL,
+// in string form) maps to which blob, plus the entrypoint the bundle was
+// built from.
+type ArchiveManifest struct {
+	Entry string                  `json:"entry"`
+	Files map[string]ArchiveEntry `json:"files"`
+	// Aliases maps a bare specifier (`require("lodash")`'s argument, not a
+	// resolved path) to the Files key it resolved to when the archive was
+	// recorded, so a replay can look a bare specifier's program up
+	// directly instead of re-running node_modules resolution against the
+	// archive's filesystem (which doesn't mirror a real node_modules tree).
+	Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+// ArchiveWriter incrementally builds a tar archive holding a manifest plus
+// every blob it refers to. Safe for use by a single InitContext, which
+// records into it as init-phase requires and opens happen.
+type ArchiveWriter struct {
+	tw       *tar.Writer
+	manifest ArchiveManifest
+	seq      int
+}
+
+// NewArchiveWriter starts a new archive, written incrementally to w as
+// blobs are added; call Close to flush the manifest and finish the tar
+// stream.
+func NewArchiveWriter(w io.Writer, entry string) *ArchiveWriter {
+	return &ArchiveWriter{
+		tw: tar.NewWriter(w),
+		manifest: ArchiveManifest{
+			Entry: entry,
+			Files: make(map[string]ArchiveEntry),
+		},
+	}
+}
+
+// Put records specifier's data at a fresh path in the archive, under the
+// given kind, unless specifier was already recorded.
+func (a *ArchiveWriter) Put(specifier string, kind ArchiveEntryKind, data []byte) error {
+	if _, ok := a.manifest.Files[specifier]; ok {
+		return nil
+	}
+
+	a.seq++
+	path := string(kind) + "/" + strconv.Itoa(a.seq)
+	if err := a.tw.WriteHeader(&tar.Header{
+		Name: path,
+		Mode: 0o644,
+		Size: int64(len(data)),
+	}); err != nil {
+		return errors.Wrapf(err, "couldn't write archive entry for %q", specifier)
+	}
+	if _, err := a.tw.Write(data); err != nil {
+		return errors.Wrapf(err, "couldn't write archive entry for %q", specifier)
+	}
+
+	a.manifest.Files[specifier] = ArchiveEntry{Kind: kind, Path: path}
+	return nil
+}
+
+// Alias records that specifier (a bare require() specifier, not a resolved
+// path) resolved to target - another specifier already (or later) recorded
+// with Put - so a replay can use target's blob directly for specifier
+// without resolving it again. A no-op if specifier is already aliased.
+func (a *ArchiveWriter) Alias(specifier, target string) {
+	if _, ok := a.manifest.Aliases[specifier]; ok {
+		return
+	}
+	if a.manifest.Aliases == nil {
+		a.manifest.Aliases = make(map[string]string)
+	}
+	a.manifest.Aliases[specifier] = target
+}
+
+// Close writes the manifest and finishes the underlying tar stream. The
+// manifest is written last, so it indexes only blobs that were actually
+// flushed successfully.
+func (a *ArchiveWriter) Close() error {
+	data, err := json.Marshal(a.manifest)
+	if err != nil {
+		return err
+	}
+	if err := a.tw.WriteHeader(&tar.Header{
+		Name: manifestPath,
+		Mode: 0o644,
+		Size: int64(len(data)),
+	}); err != nil {
+		return err
+	}
+	if _, err := a.tw.Write(data); err != nil {
+		return err
+	}
+	return a.tw.Close()
+}
+
+// OpenArchive reads a bundle written by ArchiveWriter, returning its
+// manifest and an in-memory afero.Fs with every blob extracted under its
+// recorded path, so it can be read back out with afero.ReadFile(fs, path).
+func OpenArchive(r io.Reader) (*ArchiveManifest, afero.Fs, error) {
+	fs := afero.NewMemMapFs()
+	tr := tar.NewReader(r)
+
+	var manifest *ArchiveManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "couldn't read bundle archive")
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "couldn't read bundle entry %q", hdr.Name)
+		}
+
+		if hdr.Name == manifestPath {
+			var m ArchiveManifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				return nil, nil, errors.Wrap(err, "couldn't parse bundle manifest")
+			}
+			manifest = &m
+			continue
+		}
+
+		if err := afero.WriteFile(fs, hdr.Name, data, 0o644); err != nil {
+			return nil, nil, errors.Wrapf(err, "couldn't extract bundle entry %q", hdr.Name)
+		}
+	}
+
+	if manifest == nil {
+		return nil, nil, errors.New("bundle archive has no manifest.json")
+	}
+	return manifest, fs, nil
+}
@@ -0,0 +1,120 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package loader resolves and reads module sources for the JS runtime, from
+// the local filesystem as well as remote HTTP(S) origins.
+package loader
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// SourceData wraps the raw bytes of a loaded module along with the resolved
+// URL it was ultimately read from.
+type SourceData struct {
+	Data     []byte
+	Filename string
+	URL      *url.URL
+}
+
+// Dir returns the "directory" a module was loaded from, i.e. the base that
+// sibling relative imports should be resolved against. For file:// URLs this
+// is the parent directory; for http(s):// URLs it is the parent of the
+// URL's path, origin included.
+func Dir(u *url.URL) *url.URL {
+	d := *u
+	d.Path = path.Dir(d.Path)
+	if d.Path != "/" {
+		d.Path += "/"
+	}
+	return &d
+}
+
+// Resolve turns a specifier as it appears in source (relative, absolute, a
+// remote URL, or a bare package name) into an absolute *url.URL, resolved
+// against pwd - the base that relative specifiers are anchored to.
+//
+// pwd may be a file:// URL (the common case, rooted at the local working
+// directory) or an http(s):// URL when the importing module was itself
+// loaded remotely; in the latter case a relative `require("./helper.js")`
+// resolves against that module's origin and path, not the local filesystem.
+//
+// fs and pkgCache are only consulted for bare specifiers (`require("lodash")`),
+// which are looked up via the Node.js node_modules resolution algorithm;
+// pkgCache memoizes package.json files parsed along the way, and is expected
+// to outlive a single call (InitContext keeps one for its whole run).
+func Resolve(fs afero.Fs, pkgCache map[string]*PackageJSON, pwd *url.URL, name string) (*url.URL, error) {
+	if pwd == nil {
+		return nil, errors.New("loader: missing base for resolving " + name)
+	}
+	if name == "" {
+		return nil, errors.New("loader: local or remote path required")
+	}
+
+	if u, err := url.Parse(name); err == nil && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "file") {
+		return u, nil
+	}
+
+	if IsBareSpecifier(name) {
+		return ResolveNodeModule(fs, pwd, name, pkgCache)
+	}
+
+	switch pwd.Scheme {
+	case "https", "http":
+		ref, err := url.Parse(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse import %q", name)
+		}
+		return pwd.ResolveReference(ref), nil
+	default:
+		resolved := *pwd
+		if strings.HasPrefix(name, "/") {
+			resolved.Path = name
+		} else {
+			resolved.Path = path.Join(pwd.Path, name)
+		}
+		return &resolved, nil
+	}
+}
+
+// Load reads the module the given url points to, from the local filesystem
+// for file:// URLs, and from the network (through the on-disk remote cache)
+// for http(s):// URLs.
+func Load(fs afero.Fs, u *url.URL, originalName string) (*SourceData, error) {
+	switch u.Scheme {
+	case "https", "http":
+		data, err := loadRemote(u)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't load %q", originalName)
+		}
+		return &SourceData{Data: data, Filename: u.String(), URL: u}, nil
+	default:
+		data, err := afero.ReadFile(fs, u.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't load %q", originalName)
+		}
+		return &SourceData{Data: data, Filename: u.Path, URL: u}, nil
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// PackageJSON is the subset of package.json fields the Node.js resolution
+// algorithm cares about. Exports and Imports are kept raw rather than
+// decoded straight into a subpath map: Node allows either field to also be
+// a bare string, or a conditions object with no subpaths at all, and
+// committing to one shape at decode time would fail the whole document (and
+// lose Main/Browser along with it) for a package.json using either of
+// those. See exportsMap.
+type PackageJSON struct {
+	Name    string          `json:"name"`
+	Main    string          `json:"main"`
+	Browser string          `json:"browser"`
+	Exports json.RawMessage `json:"exports"`
+	Imports json.RawMessage `json:"imports"`
+}
+
+// exportsMap normalizes raw - a parsed PackageJSON's Exports or Imports
+// field - into the subpath map the rest of this file works with, handling
+// the two shapes Node allows besides a plain subpath map: a bare string
+// ("exports": "./index.js", shorthand for {".": "./index.js"}) and a
+// conditions object with no subpaths ("exports": {"node": "...", "default":
+// "..."}, shorthand for {".": {"node": "...", "default": "..."}}).
+func exportsMap(raw json.RawMessage) (map[string]json.RawMessage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var asString string
+	if err := json.Unmarshal(raw, &asString); err == nil {
+		return map[string]json.RawMessage{".": raw}, nil
+	}
+
+	var asMap map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &asMap); err != nil {
+		return nil, errors.Wrap(err, `unsupported "exports"/"imports" shape`)
+	}
+	for key := range asMap {
+		if !strings.HasPrefix(key, ".") && !strings.HasPrefix(key, "#") {
+			// Not a subpath map after all - a conditions object for the
+			// package's single "." export, keyed by condition name instead
+			// of subpath.
+			return map[string]json.RawMessage{".": raw}, nil
+		}
+	}
+	return asMap, nil
+}
+
+// conditions are tried, in order, against each "exports"/"imports" entry.
+// "k6" lets package authors ship a k6-specific build the same way they'd
+// ship a "browser" or "node" one; "default" is the catch-all Node itself
+// falls back to.
+var conditions = []string{"k6", "default"}
+
+// IsBareSpecifier reports whether name is a "bare" module specifier - a
+// package name or subpath to be looked up in node_modules, as opposed to a
+// relative/absolute path or a fully qualified URL.
+func IsBareSpecifier(name string) bool {
+	switch {
+	case name == "", strings.HasPrefix(name, "."), strings.HasPrefix(name, "/"):
+		return false
+	}
+	if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+		return false
+	}
+	return true
+}
+
+// ResolveNodeModule implements (a practical subset of) the Node.js
+// CommonJS resolution algorithm for a bare specifier: it walks up from pwd
+// looking for a node_modules/<name> directory, honoring package.json's
+// "exports" map (with a "k6" condition alongside the standard "default"
+// one), "main", "browser", and the "imports" field for
+// "#internal" specifiers, falling back to "<name>/index.js".
+//
+// pkgCache memoizes parsed package.json files across calls, indexed by their
+// path on disk; callers own its lifetime (InitContext keeps one per run).
+func ResolveNodeModule(fs afero.Fs, pwd *url.URL, name string, pkgCache map[string]*PackageJSON) (*url.URL, error) {
+	if strings.HasPrefix(name, "#") {
+		return resolveImportsField(fs, pwd, name, pkgCache)
+	}
+
+	pkgName, subpath := splitSpecifier(name)
+
+	for dir := pwd.Path; ; {
+		candidate := path.Join(dir, "node_modules", pkgName)
+		if ok, _ := afero.DirExists(fs, candidate); ok {
+			u, err := resolvePackageDir(fs, *pwd, candidate, subpath, pkgCache)
+			if err != nil {
+				// candidate is the right node_modules/pkgName directory -
+				// a package.json that exists but doesn't parse is this
+				// package's own error, not a reason to keep walking up as
+				// though the package weren't here at all.
+				return nil, err
+			}
+			return u, nil
+		}
+
+		parent := path.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	return nil, errors.Errorf("couldn't find package %q in any node_modules directory above %s", pkgName, pwd.Path)
+}
+
+// splitSpecifier splits a bare specifier into its package name and subpath,
+// e.g. "lodash/fp" -> ("lodash", "fp"), "@org/pkg/sub" -> ("@org/pkg", "sub").
+func splitSpecifier(name string) (pkgName, subpath string) {
+	parts := strings.SplitN(name, "/", 2)
+	if strings.HasPrefix(name, "@") && len(parts) == 2 {
+		scopedParts := strings.SplitN(parts[1], "/", 2)
+		if len(scopedParts) == 2 {
+			return parts[0] + "/" + scopedParts[0], scopedParts[1]
+		}
+		return name, ""
+	}
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return name, ""
+}
+
+func resolvePackageDir(fs afero.Fs, base url.URL, dir, subpath string, pkgCache map[string]*PackageJSON) (*url.URL, error) {
+	pkg, err := loadPackageJSON(fs, path.Join(dir, "package.json"), pkgCache)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "couldn't resolve %s", dir)
+		}
+		pkg = &PackageJSON{}
+	}
+
+	// An "exports" shape this resolver doesn't understand is treated the
+	// same as no "exports" at all, rather than failing resolution outright
+	// - "main"/"browser" (parsed independently, see PackageJSON) are still
+	// honored below.
+	exports, _ := exportsMap(pkg.Exports)
+
+	if subpath != "" {
+		if exports != nil {
+			if entry, ok := exports["./"+subpath]; ok {
+				if resolved := pickCondition(entry); resolved != "" {
+					base.Path = path.Join(dir, resolved)
+					return &base, nil
+				}
+			}
+		}
+		base.Path = path.Join(dir, subpath)
+		return &base, nil
+	}
+
+	if exports != nil {
+		if entry, ok := exports["."]; ok {
+			if resolved := pickCondition(entry); resolved != "" {
+				base.Path = path.Join(dir, resolved)
+				return &base, nil
+			}
+		}
+	}
+	if pkg.Browser != "" {
+		base.Path = path.Join(dir, pkg.Browser)
+		return &base, nil
+	}
+	if pkg.Main != "" {
+		base.Path = path.Join(dir, pkg.Main)
+		return &base, nil
+	}
+
+	base.Path = path.Join(dir, "index.js")
+	return &base, nil
+}
+
+// pickCondition resolves a (possibly nested) exports/imports map entry
+// against the known conditions, falling back to a plain string value.
+func pickCondition(raw json.RawMessage) string {
+	var asString string
+	if err := json.Unmarshal(raw, &asString); err == nil {
+		return asString
+	}
+
+	var asMap map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &asMap); err == nil {
+		for _, cond := range conditions {
+			if v, ok := asMap[cond]; ok {
+				if s := pickCondition(v); s != "" {
+					return s
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func resolveImportsField(fs afero.Fs, pwd *url.URL, name string, pkgCache map[string]*PackageJSON) (*url.URL, error) {
+	for dir := pwd.Path; ; {
+		pkgPath := path.Join(dir, "package.json")
+		if ok, _ := afero.Exists(fs, pkgPath); ok {
+			pkg, err := loadPackageJSON(fs, pkgPath, pkgCache)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't resolve internal import specifier %q", name)
+			}
+			imports, err := exportsMap(pkg.Imports)
+			if err != nil {
+				return nil, errors.Wrapf(err, `package.json "imports" in %s`, dir)
+			}
+			if entry, ok := imports[name]; ok {
+				if resolved := pickCondition(entry); resolved != "" {
+					u := *pwd
+					u.Path = path.Join(dir, resolved)
+					return &u, nil
+				}
+			}
+			break // the first package.json found is authoritative for "imports".
+		}
+		parent := path.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return nil, errors.Errorf("couldn't resolve internal import specifier %q", name)
+}
+
+func loadPackageJSON(fs afero.Fs, pkgPath string, pkgCache map[string]*PackageJSON) (*PackageJSON, error) {
+	if pkg, ok := pkgCache[pkgPath]; ok {
+		return pkg, nil
+	}
+
+	data, err := afero.ReadFile(fs, pkgPath)
+	if err != nil {
+		return nil, err
+	}
+	pkg := &PackageJSON{}
+	if err := json.Unmarshal(data, pkg); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse %s", pkgPath)
+	}
+	pkgCache[pkgPath] = pkg
+	return pkg, nil
+}
@@ -0,0 +1,91 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestResolveNodeModuleExportsStringShorthand(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	pkgJSON := `{"name": "pkg", "exports": "./shorthand.js"}`
+	if err := afero.WriteFile(fs, "/node_modules/pkg/package.json", []byte(pkgJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/node_modules/pkg/shorthand.js", []byte("1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	pwd := &url.URL{Scheme: "file", Path: "/"}
+	u, err := ResolveNodeModule(fs, pwd, "pkg", map[string]*PackageJSON{})
+	if err != nil {
+		t.Fatalf("ResolveNodeModule: %v", err)
+	}
+	if want := "/node_modules/pkg/shorthand.js"; u.Path != want {
+		t.Errorf("resolved %q, want %q", u.Path, want)
+	}
+}
+
+func TestResolveNodeModuleMainSurvivesUnsupportedExportsShape(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	// "exports" as an array isn't a shape this resolver supports, but that
+	// shouldn't keep "main" from still being found - nor should it make
+	// resolution fail outright.
+	pkgJSON := `{"name": "pkg", "exports": ["a", "b"], "main": "./main.js"}`
+	if err := afero.WriteFile(fs, "/node_modules/pkg/package.json", []byte(pkgJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/node_modules/pkg/main.js", []byte("1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	pwd := &url.URL{Scheme: "file", Path: "/"}
+	u, err := ResolveNodeModule(fs, pwd, "pkg", map[string]*PackageJSON{})
+	if err != nil {
+		t.Fatalf("ResolveNodeModule: %v", err)
+	}
+	if want := "/node_modules/pkg/main.js"; u.Path != want {
+		t.Errorf("resolved %q, want %q", u.Path, want)
+	}
+}
+
+func TestResolveNodeModuleMalformedPackageJSONIsAnError(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/node_modules/pkg/package.json", []byte("{not valid json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/node_modules/pkg/index.js", []byte("1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	pwd := &url.URL{Scheme: "file", Path: "/"}
+	_, err := ResolveNodeModule(fs, pwd, "pkg", map[string]*PackageJSON{})
+	if err == nil {
+		t.Fatalf("expected a malformed package.json to surface as a real error, not a silent index.js guess")
+	}
+	if !strings.Contains(err.Error(), "couldn't parse") {
+		t.Fatalf("expected the JSON parse error to surface, got a different error instead: %v", err)
+	}
+}
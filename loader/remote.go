@@ -0,0 +1,130 @@
+/*
+ *
+ * k6 - a next-generation load testing tool
+ * Copyright (C) 2016 Load Impact
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package loader
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// remoteCacheDir returns the directory remote module sources are cached in,
+// overridable through K6_MODULE_CACHE_DIR for tests and unusual setups.
+func remoteCacheDir() (string, error) {
+	if dir := os.Getenv("K6_MODULE_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "k6", "modcache"), nil
+}
+
+// cacheKey derives the on-disk filename a remote module is stored under,
+// from its URL (without the integrity fragment) and its integrity hash, if
+// any - so the same URL fetched with two different expected hashes doesn't
+// collide.
+func cacheKey(u *url.URL, integrity string) string {
+	clean := *u
+	clean.Fragment = ""
+	sum := sha256.Sum256([]byte(clean.String() + "|" + integrity))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyIntegrity checks data against a subresource-integrity style hash of
+// the form "sha384-<base64 digest>". Only sha384 is supported, matching the
+// SRI spec's recommended algorithm.
+func verifyIntegrity(data []byte, integrity string) error {
+	const prefix = "sha384-"
+	if !strings.HasPrefix(integrity, prefix) {
+		return errors.Errorf("unsupported integrity format %q, expected sha384-...", integrity)
+	}
+	sum := sha512.Sum384(data)
+	got := base64.StdEncoding.EncodeToString(sum[:])
+	if got != strings.TrimPrefix(integrity, prefix) {
+		return errors.Errorf("integrity mismatch: expected %s, got sha384-%s", integrity, got)
+	}
+	return nil
+}
+
+// loadRemote fetches the module at u over HTTP(S), verifying it against the
+// integrity hash carried in u's fragment (if any), and serves it from the
+// on-disk cache on subsequent calls instead of hitting the network again.
+func loadRemote(u *url.URL) ([]byte, error) {
+	integrity := u.Fragment
+
+	cacheDir, err := remoteCacheDir()
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't determine module cache directory")
+	}
+	cachePath := filepath.Join(cacheDir, cacheKey(u, integrity))
+
+	if cached, err := ioutil.ReadFile(cachePath); err == nil {
+		return cached, nil
+	}
+
+	fetchURL := *u
+	fetchURL.Fragment = ""
+	resp, err := http.Get(fetchURL.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't fetch %s", fetchURL.String())
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("bad status fetching %s: %s", fetchURL.String(), resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read %s", fetchURL.String())
+	}
+
+	if integrity != "" {
+		if err := verifyIntegrity(data, integrity); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "couldn't create module cache directory")
+	}
+	tmp, err := ioutil.TempFile(cacheDir, "tmp-*")
+	if err == nil {
+		if _, err := tmp.Write(data); err == nil {
+			_ = tmp.Close()
+			_ = os.Rename(tmp.Name(), cachePath)
+		} else {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}
+
+	return data, nil
+}